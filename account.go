@@ -0,0 +1,125 @@
+package certmagic_nats
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// jwtSigner returns the handler signing the server nonce for JWTs of
+// JWTProvider. Without JWTSigner the seed is read from creds on every
+// connect, so rotated creds files are picked up as well.
+func (n *Nats) jwtSigner(creds string) nats.SignatureHandler {
+	if n.JWTSigner != nil {
+		return n.JWTSigner
+	}
+
+	return func(nonce []byte) ([]byte, error) {
+		contents, err := os.ReadFile(creds)
+		if err != nil {
+			return nil, fmt.Errorf("reading creds %v: %w", creds, err)
+		}
+		kp, err := nkeys.ParseDecoratedNKey(contents)
+		if err != nil {
+			return nil, fmt.Errorf("nkey seed in creds %v: %w", creds, err)
+		}
+		defer kp.Wipe()
+		return kp.Sign(nonce)
+	}
+}
+
+// validateAccount checks that the credentials used to connect belong to
+// Account. NATS selects the account from the user JWT, so the account
+// can't be chosen at connect time, only verified.
+func (n *Nats) validateAccount() error {
+	if n.Account == "" {
+		return nil
+	}
+
+	if n.Creds == "" {
+		return fmt.Errorf("account %v requires creds to select the account", n.Account)
+	}
+
+	for _, creds := range []string{n.Creds, n.ReadCreds} {
+		if creds == "" {
+			continue
+		}
+
+		account, err := credsAccount(creds)
+		if err != nil {
+			return err
+		}
+		if account != n.Account {
+			return fmt.Errorf("creds %v belong to account %v, not the configured account %v", creds, account, n.Account)
+		}
+	}
+	return nil
+}
+
+// credsAccount returns the public key of the account which issued the
+// user JWT in the creds file.
+func credsAccount(creds string) (string, error) {
+	contents, err := os.ReadFile(creds)
+	if err != nil {
+		return "", fmt.Errorf("reading creds: %w", err)
+	}
+
+	token, err := jwt.ParseDecoratedJWT(contents)
+	if err != nil {
+		return "", fmt.Errorf("parsing creds %v: %w", creds, err)
+	}
+
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		return "", fmt.Errorf("decoding user jwt in %v: %w", creds, err)
+	}
+
+	// users signed by a signing key name their account separately
+	if claims.IssuerAccount != "" {
+		return claims.IssuerAccount, nil
+	}
+	return claims.Issuer, nil
+}
+
+// checkAccountStorage compares the JetStream storage left to the
+// account with MinAccountStorage. The limit of the storage type of the
+// bucket applies, memory or file.
+func (n *Nats) checkAccountStorage() error {
+	if n.MinAccountStorage <= 0 {
+		return nil
+	}
+
+	kv, js := n.writer()
+	if kv == nil {
+		n.logger.Warn("Not connected, can't check the account storage")
+		return nil
+	}
+
+	info, err := js.AccountInfo()
+	if err != nil {
+		return fmt.Errorf("min_account_storage: %w", err)
+	}
+	limit, used, kind := info.Limits.MaxStore, info.Store, "file"
+	if status, err := kv.Status(); err == nil {
+		if s, ok := status.(*nats.KeyValueBucketStatus); ok && s.StreamInfo().Config.Storage == nats.MemoryStorage {
+			limit, used, kind = info.Limits.MaxMemory, info.Memory, "memory"
+		}
+	}
+	if limit < 0 {
+		return nil
+	}
+
+	left := limit - int64(used)
+	if left >= n.MinAccountStorage {
+		return nil
+	}
+	err = fmt.Errorf("%w: %d bytes of %v storage left of %d, want at least %d", ErrAccountStorage, max(left, 0), kind, limit, n.MinAccountStorage)
+	if n.RequireAccountStorage {
+		return err
+	}
+	n.logger.Warn(err.Error())
+	return nil
+}
@@ -0,0 +1,50 @@
+package certmagic_nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// publishAsync publishes msg without waiting for the server to
+// acknowledge it. The ack is awaited by Flush.
+func (n *Nats) publishAsync(js nats.JetStreamContext, msg *nats.Msg) error {
+	fut, err := js.PublishMsgAsync(msg)
+	if err != nil {
+		return err
+	}
+
+	n.pendingLock.Lock()
+	defer n.pendingLock.Unlock()
+	n.pending = append(n.pending, fut)
+	return nil
+}
+
+// Flush waits until all writes issued with AsyncWrites were
+// acknowledged by the server, returning the errors of failed writes or
+// the context error if ctx is done first.
+func (n *Nats) Flush(ctx context.Context) error {
+	n.pendingLock.Lock()
+	pending := n.pending
+	n.pending = nil
+	n.pendingLock.Unlock()
+
+	var errs []error
+	for i, fut := range pending {
+		select {
+		case <-fut.Ok():
+		case err := <-fut.Err():
+			errs = append(errs, fmt.Errorf("async write to %v: %w", fut.Msg().Subject, err))
+		case <-ctx.Done():
+			// keep what is still outstanding for the next Flush
+			n.pendingLock.Lock()
+			n.pending = append(pending[i:], n.pending...)
+			n.pendingLock.Unlock()
+			return ctx.Err()
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,75 @@
+package certmagic_nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned without contacting NATS while the circuit
+// breaker is open after repeated storage failures.
+var ErrBreakerOpen = errors.New("circuit breaker open: nats storage unavailable")
+
+// breaker short circuits operations after threshold consecutive
+// failures until cooldown has passed. A nil breaker never opens.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrBreakerOpen while the breaker is open. Once the
+// cooldown passed calls are let through again to probe the storage.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold && time.Since(b.openedAt) < b.cooldown {
+		return fmt.Errorf("%w, retrying after %v", ErrBreakerOpen, b.openedAt.Add(b.cooldown).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// record tracks the outcome of an operation, opening the breaker once
+// threshold failures happened in a row and closing it on success.
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isFailure(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// isFailure reports whether err indicates that the storage is
+// unhealthy, as opposed to expected results like a missing key.
+func isFailure(err error) bool {
+	if err == nil || isKeyNotFound(err) || isWrongSequence(err) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrConcurrentModification) || errors.Is(err, ErrPermission) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
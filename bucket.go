@@ -0,0 +1,221 @@
+package certmagic_nats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// validateBucketConfig checks the user supplied BucketConfig and fills
+// in the bucket name from it if necessary.
+func (n *Nats) validateBucketConfig() error {
+	cfg := n.BucketConfig
+	if cfg == nil {
+		if n.Placement != nil {
+			return fmt.Errorf("placement: only applies to buckets created from bucket_config")
+		}
+		if n.RepublishSubject != "" {
+			return fmt.Errorf("republish_subject: only applies to buckets created from bucket_config")
+		}
+		if n.StreamReplicas > 0 || n.StreamRetention != "" || n.StreamDiscard != "" || n.StreamMaxMsgsPerSubject > 0 || n.StreamMaxBytes > 0 {
+			return fmt.Errorf("stream options only apply to buckets created from bucket_config")
+		}
+		return nil
+	}
+
+	if cfg.Bucket == "" {
+		cfg.Bucket = n.Bucket
+	}
+	if n.Bucket == "" {
+		n.Bucket = cfg.Bucket
+	}
+
+	if cfg.Bucket == "" {
+		return fmt.Errorf("bucket_config: bucket name is required")
+	}
+	if cfg.Bucket != n.Bucket {
+		return fmt.Errorf("bucket_config: bucket %q doesn't match bucket %q", cfg.Bucket, n.Bucket)
+	}
+	if n.StreamMaxMsgsPerSubject > 0 {
+		if cfg.History > 0 && int64(cfg.History) != n.StreamMaxMsgsPerSubject {
+			return fmt.Errorf("stream_max_msgs_per_subject: bucket_config already has a history of %d", cfg.History)
+		}
+		if n.StreamMaxMsgsPerSubject > nats.KeyValueMaxHistory {
+			return fmt.Errorf("stream_max_msgs_per_subject: %d exceeds the maximum history of %d", n.StreamMaxMsgsPerSubject, nats.KeyValueMaxHistory)
+		}
+		cfg.History = uint8(n.StreamMaxMsgsPerSubject)
+	}
+	if cfg.History > nats.KeyValueMaxHistory {
+		return fmt.Errorf("bucket_config: history %d exceeds maximum of %d", cfg.History, nats.KeyValueMaxHistory)
+	}
+	if n.StreamMaxBytes > 0 {
+		if cfg.MaxBytes > 0 && cfg.MaxBytes != n.StreamMaxBytes {
+			return fmt.Errorf("stream_max_bytes: bucket_config already has max bytes of %d", cfg.MaxBytes)
+		}
+		// every key keeps up to history revisions, the budget must at
+		// least hold the full history of one maximum sized value
+		history := int64(max(cfg.History, 1))
+		if cfg.MaxValueSize > 0 && n.StreamMaxBytes < history*int64(cfg.MaxValueSize) {
+			return fmt.Errorf("stream_max_bytes: %d bytes can't hold %d revisions of values up to %d bytes", n.StreamMaxBytes, history, cfg.MaxValueSize)
+		}
+		cfg.MaxBytes = n.StreamMaxBytes
+	}
+	if cfg.TTL > 0 && time.Duration(n.DedupWindow) > cfg.TTL {
+		return fmt.Errorf("dedup_window: %v exceeds the bucket ttl of %v", time.Duration(n.DedupWindow), cfg.TTL)
+	}
+	if cfg.Mirror != nil && len(cfg.Sources) > 0 {
+		return fmt.Errorf("bucket_config: a bucket can't have both a mirror and sources")
+	}
+
+	if n.Placement != nil {
+		if cfg.Placement != nil {
+			return fmt.Errorf("placement: bucket_config already has a placement")
+		}
+		cfg.Placement = n.Placement
+	}
+	if p := cfg.Placement; p != nil && p.Cluster == "" && len(p.Tags) == 0 {
+		return fmt.Errorf("placement: a cluster or tags are required")
+	}
+
+	if n.StreamReplicas > 0 {
+		if cfg.Replicas > 0 && cfg.Replicas != n.StreamReplicas {
+			return fmt.Errorf("stream_replicas: bucket_config already has %d replicas", cfg.Replicas)
+		}
+		cfg.Replicas = n.StreamReplicas
+	}
+	switch n.StreamRetention {
+	case "", "limits":
+	default:
+		return fmt.Errorf("stream_retention: buckets need the limits retention policy, not %q", n.StreamRetention)
+	}
+	switch n.StreamDiscard {
+	case "", "new", "old":
+	default:
+		return fmt.Errorf("unknown stream_discard %q, must be %q or %q", n.StreamDiscard, "new", "old")
+	}
+
+	if n.RepublishSubject != "" {
+		if cfg.RePublish != nil {
+			return fmt.Errorf("republish_subject: bucket_config already has a republish config")
+		}
+		cfg.RePublish = &nats.RePublish{Destination: n.RepublishSubject}
+	}
+	return nil
+}
+
+// createBucket creates the bucket from BucketConfig, used when binding
+// fails because it doesn't exist yet.
+func (n *Nats) createBucket(nc *nats.Conn) (nats.JetStreamContext, nats.KeyValue, error) {
+	js, err := nc.JetStream(nats.PublishAsyncMaxPending(256))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kv, err := js.CreateKeyValue(n.BucketConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create bucket %v: %w", n.BucketConfig.Bucket, err)
+	}
+
+	// the kv api always creates buckets discarding new messages, with
+	// a duplicate window of up to two minutes
+	if n.StreamDiscard == "old" || n.DedupWindow > 0 {
+		info, err := js.StreamInfo(kvStream(kv))
+		if err != nil {
+			return nil, nil, fmt.Errorf("create bucket %v: %w", n.BucketConfig.Bucket, err)
+		}
+		if n.StreamDiscard == "old" {
+			info.Config.Discard = nats.DiscardOld
+		}
+		if n.DedupWindow > 0 {
+			info.Config.Duplicates = time.Duration(n.DedupWindow)
+		}
+		if _, err := js.UpdateStream(&info.Config); err != nil {
+			return nil, nil, fmt.Errorf("create bucket %v: set stream config: %w", n.BucketConfig.Bucket, err)
+		}
+	}
+
+	n.logger.Info(fmt.Sprintf("Created bucket %v", n.BucketConfig.Bucket))
+	return js, kv, nil
+}
+
+// VerifyBucketConfig compares the live bucket with BucketConfig and
+// returns ErrBucketDrift listing every difference, e.g. after the
+// bucket was edited with the nats cli. Fields left unset in
+// BucketConfig, apart from the storage type, aren't compared.
+func (n *Nats) VerifyBucketConfig(ctx context.Context) error {
+	cfg := n.BucketConfig
+	if cfg == nil {
+		return nil
+	}
+
+	var info *nats.StreamInfo
+	err := n.run("VerifyBucketConfig", cfg.Bucket, func() (err error) {
+		kv, js := n.writer()
+		info, err = js.StreamInfo(kvStream(kv), nats.Context(ctx))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	diff := func(name string, got, want any) {
+		diffs = append(diffs, fmt.Sprintf("%s is %v, want %v", name, got, want))
+	}
+	live := info.Config
+	if cfg.Replicas > 0 && live.Replicas != cfg.Replicas {
+		diff("replicas", live.Replicas, cfg.Replicas)
+	}
+	if live.Storage != cfg.Storage {
+		diff("storage", live.Storage, cfg.Storage)
+	}
+	if cfg.TTL > 0 && live.MaxAge != cfg.TTL {
+		diff("ttl", live.MaxAge, cfg.TTL)
+	}
+	if cfg.History > 0 && live.MaxMsgsPerSubject != int64(cfg.History) {
+		diff("history", live.MaxMsgsPerSubject, cfg.History)
+	}
+	if cfg.MaxBytes > 0 && live.MaxBytes != cfg.MaxBytes {
+		diff("max_bytes", live.MaxBytes, cfg.MaxBytes)
+	}
+	if cfg.MaxValueSize > 0 && live.MaxMsgSize != cfg.MaxValueSize {
+		diff("max_value_size", live.MaxMsgSize, cfg.MaxValueSize)
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("bucket %v: %w: %s", cfg.Bucket, ErrBucketDrift, strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// checkEmptyBucket fails if the bucket already holds keys, used with
+// RequireEmptyBucket to catch the reuse of a shared bucket.
+func (n *Nats) checkEmptyBucket() error {
+	kv, _ := n.writer()
+	if kv == nil {
+		n.logger.Warn("Not connected, can't check that the bucket is empty")
+		return nil
+	}
+
+	watcher, err := kv.WatchAll(nats.MetaOnly(), nats.IgnoreDeletes())
+	if err != nil {
+		return fmt.Errorf("require_empty_bucket: %w", err)
+	}
+	defer watcher.Stop()
+
+	var count int
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		count++
+	}
+
+	if count > 0 {
+		return fmt.Errorf("require_empty_bucket: bucket %v already holds %d keys", kv.Bucket(), count)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package certmagic_nats
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrConcurrentModification is returned by Store with CASWrites when
+// the key was written by someone else since this instance last loaded
+// or stored it. Storing again writes on top of the latest revision.
+var ErrConcurrentModification = errors.New("key modified concurrently")
+
+// storeCAS writes value only if key is still at the revision this
+// instance last saw, or at its latest revision if it saw none.
+func (n *Nats) storeCAS(key string, value []byte, hdr nats.Header) (uint64, error) {
+	nkey := n.natsKey(key)
+	last := n.getRev(nkey)
+	if last == 0 {
+		msg, err := storeOf(n.writer()).GetLastMsg(nkey)
+		switch {
+		case err == nil:
+			// deletes count as revisions here
+			last = msg.Sequence
+		case !errors.Is(err, nats.ErrMsgNotFound):
+			return 0, err
+		}
+	}
+
+	if last == 0 {
+		// the key never existed, fail if it's created in the meantime
+		expect := nats.Header{nats.ExpectedLastSubjSeqHdr: []string{"0"}}
+		for k, v := range hdr {
+			expect[k] = v
+		}
+		hdr = expect
+	}
+
+	rev, err := n.put(key, value, last, hdr)
+	if err != nil {
+		if isWrongSequence(err) {
+			n.clearRev(nkey)
+			return 0, fmt.Errorf("store %v: %w", key, ErrConcurrentModification)
+		}
+		return 0, err
+	}
+
+	n.setRev(nkey, rev)
+	return rev, nil
+}
+
+// seenRev records the revision of nkey returned by Load for CASWrites.
+func (n *Nats) seenRev(nkey string, rev uint64) {
+	if n.CASWrites {
+		n.setRev(nkey, rev)
+	}
+}
+
+func (n *Nats) clearRev(key string) {
+	n.maplock.Lock()
+	defer n.maplock.Unlock()
+	delete(n.revMap, key)
+}
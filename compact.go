@@ -0,0 +1,105 @@
+package certmagic_nats
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Compact purges the history of deleted keys, keeping delete markers
+// younger than CompactMarkerAge, and with SoftDelete and
+// SoftDeleteWindow set removes tombstones which can't be restored
+// anymore. Revisions beyond the bucket's history depth need no
+// trimming, the stream discards them on every write.
+func (n *Nats) Compact(ctx context.Context) error {
+	n.logger.Info("Compact")
+
+	err := n.run("Compact", "", func() error {
+		kv, _ := n.writer()
+		if n.SoftDelete && n.SoftDeleteWindow > 0 {
+			if err := n.purgeTombstones(ctx, kv); err != nil {
+				return err
+			}
+		}
+		return kv.PurgeDeletes(nats.DeleteMarkersOlderThan(time.Duration(n.CompactMarkerAge)), nats.Context(ctx))
+	})
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	return nil
+}
+
+// purgeTombstones purges the tombstones written before SoftDeleteWindow.
+func (n *Nats) purgeTombstones(ctx context.Context, kv nats.KeyValue) error {
+	watcher, err := kv.Watch(tombstonePrefix+">", nats.MetaOnly(), nats.IgnoreDeletes(), nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	var stale []string
+	cutoff := time.Now().Add(-time.Duration(n.SoftDeleteWindow))
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		if entry.Created().Before(cutoff) {
+			stale = append(stale, entry.Key())
+		}
+	}
+
+	for _, nkey := range stale {
+		if err := kv.Purge(nkey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startCompaction runs Compact every CompactInterval. Up to a tenth of
+// the interval is added at random, so instances started together don't
+// compact at the same time.
+func (n *Nats) startCompaction() {
+	interval := time.Duration(n.CompactInterval)
+	if interval <= 0 {
+		return
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	n.compactStop, n.compactDone = stop, done
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-stop
+			cancel()
+		}()
+
+		for {
+			jitter := time.Duration(rand.Int63n(int64(interval)/10 + 1))
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval + jitter):
+			}
+
+			if err := n.Compact(ctx); err != nil {
+				n.logger.Error(fmt.Sprintf("Scheduled compaction: %v", err))
+			}
+		}
+	}()
+}
+
+// stopCompaction ends the schedule started by startCompaction and waits
+// for a running compaction.
+func (n *Nats) stopCompaction() {
+	if n.compactStop != nil {
+		close(n.compactStop)
+		<-n.compactDone
+		n.compactStop = nil
+	}
+}
@@ -0,0 +1,115 @@
+package certmagic_nats
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// redacted replaces secrets in ResolvedConfig.
+const redacted = "REDACTED"
+
+// ResolvedConfig returns the settings in effect after Provision applied
+// defaults and the nats context, keyed by their JSON names. Passwords
+// and tokens in host and failover URLs, credentials and query values of
+// webhook URLs, default values, the fallback config and the obfuscation
+// secret are redacted.
+func (n *Nats) ResolvedConfig() map[string]any {
+	config := make(map[string]any)
+
+	v := reflect.ValueOf(n).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		switch value := v.Field(i).Interface().(type) {
+		case caddy.Duration:
+			config[name] = time.Duration(value).String()
+		default:
+			config[name] = value
+		}
+	}
+
+	config["hosts"] = redactHosts(n.Hosts)
+	config["read_hosts"] = redactHosts(n.ReadHosts)
+	if len(n.Failover) > 0 {
+		failover := make([]FailoverTarget, len(n.Failover))
+		for i, t := range n.Failover {
+			t.Hosts = redactHosts(t.Hosts)
+			failover[i] = t
+		}
+		config["failover"] = failover
+	}
+	if len(n.Webhooks) > 0 {
+		webhooks := make([]string, len(n.Webhooks))
+		for i, hook := range n.Webhooks {
+			webhooks[i] = redactURL(hook)
+		}
+		config["webhooks"] = webhooks
+	}
+	if len(n.DefaultsFor) > 0 {
+		defaults := make(map[string]string, len(n.DefaultsFor))
+		for prefix := range n.DefaultsFor {
+			defaults[prefix] = redacted
+		}
+		config["defaults_for"] = defaults
+	}
+	if n.FallbackRaw != nil {
+		config["fallback"] = redacted
+	}
+	if n.ObfuscateKeysSecret != "" {
+		config["obfuscate_keys_secret"] = redacted
+	}
+
+	config["native_ttl"] = n.nativeTTL
+	config["read_connection"] = n.readConn != nil
+	return config
+}
+
+// redactHosts removes the credentials of the comma separated host URLs.
+func redactHosts(hosts string) string {
+	if hosts == "" {
+		return ""
+	}
+
+	list := strings.Split(hosts, ",")
+	for i, host := range list {
+		u, err := url.Parse(strings.TrimSpace(host))
+		if err != nil {
+			// unparsable hosts may still hold credentials
+			list[i] = redacted
+			continue
+		}
+		if u.User != nil {
+			u.User = url.User(redacted)
+		}
+		list[i] = u.String()
+	}
+	return strings.Join(list, ",")
+}
+
+// redactURL removes the credentials and query values, e.g. tokens, of
+// a URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for k := range query {
+			query[k] = []string{redacted}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,75 @@
+package certmagic_nats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// natsContext holds the connection settings of a nats cli context file.
+type natsContext struct {
+	URL         string `json:"url"`
+	Creds       string `json:"creds"`
+	Cert        string `json:"cert"`
+	Key         string `json:"key"`
+	CA          string `json:"ca"`
+	InboxPrefix string `json:"inbox_prefix"`
+	TLSFirst    bool   `json:"tls_first"`
+}
+
+// contextPath returns the file of the named nats cli context. Names
+// containing a path separator or ending in .json are used as is.
+func contextPath(name string) (string, error) {
+	if strings.ContainsRune(name, filepath.Separator) || strings.HasSuffix(name, ".json") {
+		return name, nil
+	}
+
+	// the nats cli uses ~/.config on every platform
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("locating nats context %v: %w", name, err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "nats", "context", name+".json"), nil
+}
+
+// loadContext fills in the connection settings left unset from the nats
+// cli context named by Context.
+func (n *Nats) loadContext() error {
+	if n.Context == "" {
+		return nil
+	}
+
+	file, err := contextPath(n.Context)
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading nats context: %w", err)
+	}
+
+	var nctx natsContext
+	if err := json.Unmarshal(contents, &nctx); err != nil {
+		return fmt.Errorf("parsing nats context %v: %w", file, err)
+	}
+
+	set := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	set(&n.Hosts, nctx.URL)
+	set(&n.Creds, nctx.Creds)
+	set(&n.CertFile, nctx.Cert)
+	set(&n.KeyFile, nctx.Key)
+	set(&n.CAFile, nctx.CA)
+	set(&n.InboxPrefix, nctx.InboxPrefix)
+	n.TLSFirst = n.TLSFirst || nctx.TLSFirst
+	return nil
+}
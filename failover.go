@@ -0,0 +1,163 @@
+package certmagic_nats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultFailoverAfter is how long the active target must be unhealthy
+// before failing over when FailoverAfter isn't set.
+const defaultFailoverAfter = 30 * time.Second
+
+// FailoverTarget is a bucket, usually on another cluster, operations
+// switch to when the active one is unavailable. Unset fields fall back
+// to their primary counterparts.
+type FailoverTarget struct {
+	Hosts  string `json:"hosts,omitempty"`
+	Creds  string `json:"creds,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+}
+
+// targets returns the primary followed by the failover targets.
+func (n *Nats) targets() []FailoverTarget {
+	targets := []FailoverTarget{{Hosts: n.Hosts, Creds: n.Creds, Bucket: n.Bucket}}
+	for _, t := range n.Failover {
+		if t.Hosts == "" {
+			t.Hosts = n.Hosts
+		}
+		if t.Creds == "" {
+			t.Creds = n.Creds
+		}
+		if t.Bucket == "" {
+			t.Bucket = n.Bucket
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// startFailover watches the active target and switches to the next one
+// once it was unhealthy for FailoverAfter.
+func (n *Nats) startFailover() {
+	if len(n.Failover) == 0 {
+		return
+	}
+
+	after := time.Duration(n.FailoverAfter)
+	if after <= 0 {
+		after = defaultFailoverAfter
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	n.failoverStop, n.failoverDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(after / 5)
+		defer ticker.Stop()
+
+		var unhealthySince time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			nc, _ := n.conns()
+			if kv, _ := n.writer(); kv != nil && (nc.IsConnected() || n.isIdleClosed()) {
+				unhealthySince = time.Time{}
+				continue
+			}
+			if unhealthySince.IsZero() {
+				unhealthySince = time.Now()
+			}
+			if time.Since(unhealthySince) < after {
+				continue
+			}
+
+			n.failover()
+			// give the new target, or the old one if none was
+			// reachable, the full period before moving on
+			unhealthySince = time.Time{}
+		}
+	}()
+}
+
+// failover connects to the targets following the active one in turn,
+// wrapping around to the primary, and makes the first reachable one
+// active. It holds idleLock so closing and reconnecting idle
+// connections see a consistent active target.
+func (n *Nats) failover() {
+	n.idleLock.Lock()
+	defer n.idleLock.Unlock()
+	if n.idleClosed {
+		// closed on purpose, reconnecting picks up the active target
+		return
+	}
+
+	targets := n.targets()
+	from := targets[n.activeTarget]
+	for i := 1; i < len(targets); i++ {
+		next := (n.activeTarget + i) % len(targets)
+		to := targets[next]
+
+		nc, err := n.connect(to.Hosts, to.Creds, to.Bucket, false)
+		if err != nil {
+			n.logger.Error(fmt.Sprintf("Failover to bucket %v at %v: %v", to.Bucket, to.Hosts, err))
+			continue
+		}
+		// with Fallback set connect returns unreachable targets lazily,
+		// without binding the bucket
+		if !nc.IsConnected() {
+			nc.Close()
+			n.logger.Error(fmt.Sprintf("Failover to bucket %v at %v: %v", to.Bucket, to.Hosts, nats.ErrNoServers))
+			continue
+		}
+
+		// the read connection belongs to the old target, reads follow
+		// the writes from now on
+		n.kvlock.Lock()
+		old, oldRead := n.conn, n.readConn
+		n.conn, n.readConn = nc, nil
+		n.readClient, n.readJS = nil, nil
+		n.kvlock.Unlock()
+		n.activeTarget = next
+
+		for _, c := range []*nats.Conn{old, oldRead} {
+			if c != nil {
+				c.Close()
+			}
+		}
+
+		// revisions and listings of the old bucket don't apply
+		n.maplock.Lock()
+		n.revMap = make(map[string]uint64)
+		n.maplock.Unlock()
+		n.listCache.reset()
+		if kv, _ := n.writer(); n.memCache.watch(kv) != nil {
+			// without a watch the cache would go stale
+			n.memCache.stop()
+			n.logger.Error(fmt.Sprintf("Failover to bucket %v: not watching for the memory cache", to.Bucket))
+		}
+		if err := n.hotCache.bind(nc); err != nil {
+			n.hotCache.stop()
+			n.logger.Error(fmt.Sprintf("Failover to bucket %v: %v", to.Bucket, err))
+		}
+
+		n.logger.Warn(fmt.Sprintf("Failed over from bucket %v at %v to bucket %v at %v", from.Bucket, from.Hosts, to.Bucket, to.Hosts))
+		return
+	}
+	n.logger.Error(fmt.Sprintf("Bucket %v at %v is unavailable and no failover target is reachable", from.Bucket, from.Hosts))
+}
+
+// stopFailover ends the watch started by startFailover and waits for a
+// failover in progress.
+func (n *Nats) stopFailover() {
+	if n.failoverStop != nil {
+		close(n.failoverStop)
+		<-n.failoverDone
+		n.failoverStop = nil
+	}
+}
@@ -0,0 +1,36 @@
+package certmagic_nats
+
+import (
+	"errors"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// ErrNotConnected is returned by operations without a fallback storage
+// while the bucket couldn't be bound yet.
+var ErrNotConnected = errors.New("not connected to nats")
+
+// fallback returns the storage operations are routed to while NATS is
+// unavailable, nil if NATS should be used.
+func (n *Nats) fallback() certmagic.Storage {
+	// reconnect before a connection closed for idleness counts as down
+	if done, err := n.wake(); err == nil {
+		done()
+	}
+	if n.Fallback == nil {
+		return nil
+	}
+
+	kv, _ := n.writer()
+	if nc, _ := n.conns(); kv != nil && nc != nil && nc.IsConnected() {
+		if n.usingFallback.CompareAndSwap(true, false) {
+			n.logger.Info("NATS is available again, leaving fallback storage")
+		}
+		return nil
+	}
+
+	if !n.usingFallback.Swap(true) {
+		n.logger.Warn("NATS is unavailable, switching to fallback storage")
+	}
+	return n.Fallback
+}
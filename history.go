@@ -0,0 +1,71 @@
+package certmagic_nats
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// recoverValue serves key after its latest value failed verification
+// with cause, first by read repair from the mirror bucket and then from
+// an earlier revision.
+func (n *Nats) recoverValue(key string, cause error) ([]byte, error) {
+	value, err := n.readRepair(key, cause)
+	if err == nil || !n.FallbackToPreviousRevision {
+		return value, err
+	}
+	return n.previousRevision(key, cause)
+}
+
+// previousRevision walks back through the history of key to the most
+// recent revision passing verification. The walk stops at a delete, an
+// older value must not resurface. cause is returned if no revision is
+// valid. The latest revision is left in place, so the value isn't
+// cached and Load keeps falling back until it is overwritten.
+func (n *Nats) previousRevision(key string, cause error) ([]byte, error) {
+	nkey := n.natsKey(key)
+	var value []byte
+	var rev uint64
+	err := n.run("PreviousRevision", key, func() error {
+		store := storeOf(n.reader())
+		entries, err := store.History(nkey)
+		if err != nil {
+			return fmt.Errorf("reading history: %w", err)
+		}
+
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := entries[i]
+			if entry.Operation() != nats.KeyValuePut {
+				return nil
+			}
+
+			data := entry.Value()
+			if n.Checksum {
+				// the checksum is only available from the raw message
+				msg, err := store.GetMsg(entry.Revision())
+				if err != nil {
+					return fmt.Errorf("reading revision %d: %w", entry.Revision(), err)
+				}
+				if verifyChecksum(msg.Data, msg.Header) != nil {
+					continue
+				}
+				data = msg.Data
+			}
+			if value, err = n.decodeValue(data); err == nil {
+				rev = entry.Revision()
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		n.logger.Error(fmt.Sprintf("Load %v: %v", key, err))
+		return nil, cause
+	}
+	if rev == 0 {
+		return nil, cause
+	}
+
+	n.logger.Warn(fmt.Sprintf("Load %v: serving revision %d, the latest revision failed: %v", key, rev, cause))
+	return value, nil
+}
@@ -0,0 +1,33 @@
+package certmagic_nats
+
+import "fmt"
+
+// keyHookSamples are typical certmagic keys the key hooks must
+// round-trip.
+var keyHookSamples = []string{
+	"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+	"certificates/acme-v02.api.letsencrypt.org-directory/wildcard_.example.com/wildcard_.example.com.key",
+	"acme/acme-v02.api.letsencrypt.org-directory/users/admin@example.com/admin.json",
+	"certificates/acme-v02.api.letsencrypt.org-directory/Example.COM/Example.COM.json",
+	"ocsp/example.com-1a2b3c4d",
+	"locks/issue_cert_example.com.lock",
+	"last_clean.json",
+}
+
+// validateKeyHooks checks KeyEncode and KeyDecode are set together and
+// are inverses of each other.
+func (n *Nats) validateKeyHooks() error {
+	if n.KeyEncode == nil && n.KeyDecode == nil {
+		return nil
+	}
+	if n.KeyEncode == nil || n.KeyDecode == nil {
+		return fmt.Errorf("KeyEncode and KeyDecode must be set together")
+	}
+
+	for _, key := range keyHookSamples {
+		if got := n.KeyDecode(n.KeyEncode(key)); got != key {
+			return fmt.Errorf("KeyDecode isn't the inverse of KeyEncode: %q round-trips to %q", key, got)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package certmagic_nats
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// defaultHotCacheTimeout is how long Load waits for a responder
+	// when HotCacheTimeout isn't set.
+	defaultHotCacheTimeout = 20 * time.Millisecond
+
+	// defaultHotCacheSize is the number of values each instance serves
+	// when HotCacheSize isn't set.
+	defaultHotCacheSize = 256
+
+	// originHeader tells instances apart on the invalidation subject.
+	originHeader = "Caddy-Origin"
+)
+
+// hotCache serves the values this instance wrote recently to all
+// instances on the same bucket over core NATS request-reply, bypassing
+// JetStream. Each held key is served on its own subject
+// <subject>.<bucket>.get.<nkey>, so a request for a key no instance
+// holds fails right away with no responders instead of waiting for the
+// timeout. Writes are announced on <subject>.<bucket>.invalidate. A
+// nil cache serves nothing.
+type hotCache struct {
+	subject string
+	timeout time.Duration
+	size    int
+	origin  string
+
+	mu      sync.Mutex
+	entries map[string]*hotEntry
+	nc      *nats.Conn
+	sub     *nats.Subscription
+	lookups cacheCounter
+}
+
+// hotEntry is a held value and the subscription serving it.
+type hotEntry struct {
+	value []byte
+	sub   *nats.Subscription
+}
+
+func newHotCache(subject, bucket string, timeout time.Duration, size int) *hotCache {
+	if subject == "" {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultHotCacheTimeout
+	}
+	if size <= 0 {
+		size = defaultHotCacheSize
+	}
+
+	origin := make([]byte, 8)
+	rand.Read(origin)
+	return &hotCache{
+		subject: subject + "." + bucket,
+		timeout: timeout,
+		size:    size,
+		origin:  hex.EncodeToString(origin),
+		entries: make(map[string]*hotEntry),
+	}
+}
+
+// bind serves the cache on nc, replacing the subscriptions on a
+// previous connection. Values held so far may have been overwritten
+// unnoticed and are dropped.
+func (c *hotCache) bind(nc *nats.Conn) error {
+	if c == nil {
+		return nil
+	}
+
+	invalidate, err := nc.Subscribe(c.subject+".invalidate", func(msg *nats.Msg) {
+		if msg.Header.Get(originHeader) != c.origin {
+			c.drop(string(msg.Data))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("hot cache: subscribe %v.invalidate: %w", c.subject, err)
+	}
+
+	c.mu.Lock()
+	old, entries := c.sub, c.entries
+	c.nc, c.sub = nc, invalidate
+	c.entries = make(map[string]*hotEntry)
+	c.mu.Unlock()
+	if old != nil {
+		old.Unsubscribe()
+	}
+	for _, e := range entries {
+		e.sub.Unsubscribe()
+	}
+	return nil
+}
+
+// getSubject is the subject nkey is served on.
+func (c *hotCache) getSubject(nkey string) string {
+	return c.subject + ".get." + nkey
+}
+
+// respond answers requests for nkey from other instances.
+func (c *hotCache) respond(nkey string) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if msg.Header.Get(originHeader) == c.origin {
+			return
+		}
+		c.mu.Lock()
+		e, ok := c.entries[nkey]
+		c.mu.Unlock()
+		if ok {
+			msg.Respond(e.value)
+		}
+	}
+}
+
+// get returns the value of nkey held by this or another instance.
+func (c *hotCache) get(ctx context.Context, nkey string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[nkey]
+	nc := c.nc
+	c.mu.Unlock()
+	if ok {
+		c.lookups.lookup(true)
+		return append([]byte(nil), e.value...), true
+	}
+	if nc == nil {
+		c.lookups.lookup(false)
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req := nats.NewMsg(c.getSubject(nkey))
+	req.Header.Set(originHeader, c.origin)
+	msg, err := nc.RequestMsgWithContext(ctx, req)
+	if err != nil {
+		c.lookups.lookup(false)
+		return nil, false
+	}
+	c.lookups.lookup(true)
+	return msg.Data, true
+}
+
+// put holds value, just written to nkey, for other instances.
+func (c *hotCache) put(nkey string, value []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[nkey]; ok {
+		e.value = append([]byte(nil), value...)
+		return
+	}
+	if c.nc == nil {
+		return
+	}
+	if len(c.entries) >= c.size {
+		// evict an arbitrary entry, it's served from the bucket again
+		for k, e := range c.entries {
+			e.sub.Unsubscribe()
+			delete(c.entries, k)
+			break
+		}
+	}
+	sub, err := c.nc.Subscribe(c.getSubject(nkey), c.respond(nkey))
+	if err != nil {
+		return
+	}
+	c.entries[nkey] = &hotEntry{value: append([]byte(nil), value...), sub: sub}
+}
+
+// invalidate drops nkey here and on all other instances before it is
+// written.
+func (c *hotCache) invalidate(nkey string) {
+	if c == nil {
+		return
+	}
+
+	c.drop(nkey)
+	c.mu.Lock()
+	nc := c.nc
+	c.mu.Unlock()
+	if nc == nil {
+		return
+	}
+	msg := nats.NewMsg(c.subject + ".invalidate")
+	msg.Header.Set(originHeader, c.origin)
+	msg.Data = []byte(nkey)
+	nc.PublishMsg(msg)
+}
+
+func (c *hotCache) drop(nkey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[nkey]; ok {
+		e.sub.Unsubscribe()
+		delete(c.entries, nkey)
+	}
+}
+
+// stop ends serving the cache.
+func (c *hotCache) stop() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	sub, entries := c.sub, c.entries
+	c.nc, c.sub = nil, nil
+	c.entries = make(map[string]*hotEntry)
+	c.mu.Unlock()
+	if sub != nil {
+		sub.Unsubscribe()
+	}
+	for _, e := range entries {
+		e.sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,135 @@
+package certmagic_nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// startIdle closes the connections once no operation ran for
+// IdleTimeout. The next operation reconnects.
+func (n *Nats) startIdle() {
+	timeout := time.Duration(n.IdleTimeout)
+	if timeout <= 0 {
+		return
+	}
+
+	n.idleStop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			n.closeIdle(timeout)
+		}
+	}(n.idleStop)
+}
+
+// closeIdle closes the connections if no operation ran or is running
+// for timeout.
+func (n *Nats) closeIdle(timeout time.Duration) {
+	n.idleLock.Lock()
+	defer n.idleLock.Unlock()
+	if n.idleClosed || n.activeOps.Load() > 0 || time.Since(time.Unix(0, n.lastOp.Load())) < timeout {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := n.Flush(ctx); errors.Is(err, context.DeadlineExceeded) {
+		return
+	} else if err != nil {
+		n.logger.Error(fmt.Sprintf("Closing idle connection: %v", err))
+	}
+
+	conn, readConn := n.conns()
+	for _, nc := range []*nats.Conn{conn, readConn} {
+		if nc != nil {
+			nc.Close()
+		}
+	}
+	n.idleClosed = true
+	n.logger.Info(fmt.Sprintf("Closed connection idle for %v", timeout))
+}
+
+// wake reconnects if the connections were closed for idleness and
+// marks an operation as running until the returned func is called.
+func (n *Nats) wake() (func(), error) {
+	if n.IdleTimeout <= 0 {
+		return func() {}, nil
+	}
+
+	n.idleLock.Lock()
+	defer n.idleLock.Unlock()
+	n.lastOp.Store(time.Now().UnixNano())
+	if n.idleClosed {
+		if err := n.reconnectIdle(); err != nil {
+			return nil, err
+		}
+		n.idleClosed = false
+	}
+	n.activeOps.Add(1)
+	return func() { n.activeOps.Add(-1) }, nil
+}
+
+// reconnectIdle connects to the active target again after closeIdle.
+func (n *Nats) reconnectIdle() error {
+	target := n.targets()[n.activeTarget]
+	nc, err := n.connect(target.Hosts, target.Creds, target.Bucket, false)
+	if err != nil {
+		return fmt.Errorf("reconnect after idle: %w", err)
+	}
+
+	// after a failover reads follow the writes
+	var rnc *nats.Conn
+	if hosts, creds, bucket, ok := n.readTarget(); ok && n.activeTarget == 0 {
+		if rnc, err = n.connect(hosts, creds, bucket, true); err != nil {
+			nc.Close()
+			return fmt.Errorf("reconnect after idle: read connection: %w", err)
+		}
+	}
+
+	n.kvlock.Lock()
+	n.conn, n.readConn = nc, rnc
+	n.kvlock.Unlock()
+
+	// changes made while closed weren't seen
+	n.listCache.reset()
+	if kv, _ := n.reader(); n.memCache.watch(kv) != nil {
+		n.memCache.stop()
+		n.logger.Error("Reconnect after idle: not watching for the memory cache")
+	}
+	if err := n.hotCache.bind(nc); err != nil {
+		n.hotCache.stop()
+		n.logger.Error(fmt.Sprintf("Reconnect after idle: %v", err))
+	}
+	n.logger.Info(fmt.Sprintf("Reconnected to %v after idle", nc.ConnectedUrlRedacted()))
+	return nil
+}
+
+// stopIdle ends the teardown started by startIdle. Closed connections
+// stay closed.
+func (n *Nats) stopIdle() {
+	if n.idleStop != nil {
+		close(n.idleStop)
+		n.idleStop = nil
+	}
+	n.idleLock.Lock()
+	n.idleClosed = false
+	n.idleLock.Unlock()
+}
+
+// isIdleClosed reports whether closeIdle closed the connections.
+func (n *Nats) isIdleClosed() bool {
+	n.idleLock.Lock()
+	defer n.idleLock.Unlock()
+	return n.idleClosed
+}
@@ -0,0 +1,53 @@
+package certmagic_nats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// startKeepalive flushes the connections every Keepalive interval in
+// which no operation ran, so middleboxes dropping idle connections see
+// traffic and a dead connection is noticed before the next operation.
+func (n *Nats) startKeepalive() {
+	interval := time.Duration(n.Keepalive)
+	if interval <= 0 {
+		return
+	}
+
+	n.keepaliveStop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			if time.Since(time.Unix(0, n.lastOp.Load())) < interval {
+				continue
+			}
+			conn, readConn := n.conns()
+			for _, nc := range []*nats.Conn{conn, readConn} {
+				if nc == nil || !nc.IsConnected() {
+					continue
+				}
+				if err := nc.FlushTimeout(interval); err != nil {
+					n.logger.Warn(fmt.Sprintf("Keepalive to %v failed: %v", nc.ConnectedUrlRedacted(), err))
+				}
+			}
+		}
+	}(n.keepaliveStop)
+}
+
+// stopKeepalive ends the keepalive started by startKeepalive.
+func (n *Nats) stopKeepalive() {
+	if n.keepaliveStop != nil {
+		close(n.keepaliveStop)
+		n.keepaliveStop = nil
+	}
+}
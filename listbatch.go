@@ -0,0 +1,63 @@
+package certmagic_nats
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// listBatchWait bounds the wait for a single batch of keys.
+const listBatchWait = 5 * time.Second
+
+// pageKeys passes the nats keys of kv matching filter to add, fetching
+// them in batches of size from a pull consumer instead of a single
+// push of all keys. Deleted keys are only passed with includeDeleted.
+// Paging stops early when add returns false.
+func pageKeys(ctx context.Context, kv nats.KeyValue, js nats.JetStreamContext, filter string, size int, includeDeleted bool, add func(nkey string) bool) error {
+	sub, err := js.PullSubscribe(kvSubject(kv, filter), "",
+		nats.BindStream(kvStream(kv)),
+		nats.DeliverLastPerSubject(),
+		nats.HeadersOnly(),
+		nats.AckNone(),
+	)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return err
+	}
+
+	subjectPrefix := kvSubject(kv, "")
+	for pending := info.NumPending; pending > 0; {
+		bctx, cancel := context.WithTimeout(ctx, listBatchWait)
+		msgs, err := sub.Fetch(size, nats.Context(bctx))
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			meta, err := msg.Metadata()
+			if err != nil {
+				return err
+			}
+			pending = meta.NumPending
+
+			switch msg.Header.Get("KV-Operation") {
+			case "DEL", "PURGE":
+				if !includeDeleted {
+					continue
+				}
+			}
+			if !add(strings.TrimPrefix(msg.Subject, subjectPrefix)) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package certmagic_nats
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// listCache keeps List results for a short time. Writes through this
+// instance invalidate the results covering the written key, writes of
+// other instances show up once the ttl passed. A nil cache keeps
+// nothing.
+type listCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[listCacheKey]listCacheEntry
+
+	lookups cacheCounter
+}
+
+type listCacheKey struct {
+	prefix    string
+	recursive bool
+}
+
+type listCacheEntry struct {
+	keys    []string
+	expires time.Time
+}
+
+func newListCache(ttl time.Duration) *listCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &listCache{ttl: ttl, entries: make(map[listCacheKey]listCacheEntry)}
+}
+
+// get returns a copy of the cached keys for the canonical prefix.
+func (c *listCache) get(prefix string, recursive bool) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := listCacheKey{prefix, recursive}
+	entry, ok := c.entries[k]
+	if !ok {
+		c.lookups.lookup(false)
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, k)
+		c.lookups.lookup(false)
+		return nil, false
+	}
+	c.lookups.lookup(true)
+	return append([]string(nil), entry.keys...), true
+}
+
+func (c *listCache) put(prefix string, recursive bool, keys []string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[listCacheKey{prefix, recursive}] = listCacheEntry{
+		keys:    append([]string(nil), keys...),
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// reset drops all results.
+func (c *listCache) reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[listCacheKey]listCacheEntry)
+}
+
+// invalidate drops the results of every prefix key is below.
+func (c *listCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		if k.prefix == "" || strings.HasPrefix(key, k.prefix+"/") {
+			delete(c.entries, k)
+		}
+	}
+}
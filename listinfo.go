@@ -0,0 +1,174 @@
+package certmagic_nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/nats-io/nats.go"
+)
+
+// ListInfo returns the KeyInfo of the keys List returns, as Stat would,
+// but reads the metadata of all of them in one pass over the bucket
+// instead of a round trip per key. Without recursive, directories
+// directly below prefix are returned as non terminal entries.
+func (n *Nats) ListInfo(ctx context.Context, prefix string, recursive bool) ([]certmagic.KeyInfo, error) {
+	n.logger.Info(fmt.Sprintf("ListInfo: %v, %v", prefix, recursive))
+	if fb := n.fallback(); fb != nil {
+		return listInfoFrom(ctx, fb, prefix, recursive)
+	}
+
+	keys, oprefix, err := n.keys(ctx, "ListInfo", prefix, false)
+	if err != nil && !errors.Is(err, ErrListTruncated) {
+		return nil, err
+	}
+	truncated := err
+
+	var msgs map[string]*nats.RawStreamMsg
+	err = n.run("ListInfo", oprefix, func() (err error) {
+		msgs, err = storeOf(n.reader()).LastMsgs(ctx, n.watchFilter(oprefix))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	terminal := make(map[string]certmagic.KeyInfo, len(keys))
+	for _, key := range keys {
+		nkey := n.natsKey(key)
+		msg, ok := msgs[nkey]
+		if !ok {
+			// hashed keys live outside of the prefix
+			var err error
+			if msg, err = n.lastMsg(nkey); err != nil {
+				continue
+			}
+		}
+		switch msg.Header.Get("KV-Operation") {
+		case "DEL", "PURGE":
+			// deleted since it was listed
+			continue
+		}
+
+		size, err := n.listedSize(nkey, msg)
+		if isKeyNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list info %v: %w", key, err)
+		}
+		terminal[key] = certmagic.KeyInfo{
+			Key:        key,
+			Modified:   msg.Time,
+			Size:       size,
+			IsTerminal: true,
+		}
+	}
+
+	existing := make([]string, 0, len(terminal))
+	for _, key := range keys {
+		if _, ok := terminal[key]; ok {
+			existing = append(existing, key)
+		}
+	}
+	names := existing
+	if !recursive {
+		names = children(existing, oprefix, false)
+	}
+	infos := make([]certmagic.KeyInfo, 0, len(names))
+	for _, name := range names {
+		ki, ok := terminal[name]
+		if !ok {
+			// only keys still stored below name make it a directory
+			ki = certmagic.KeyInfo{Key: name}
+		}
+		infos = append(infos, ki)
+	}
+	return infos, truncated
+}
+
+// listedSize returns the size of the value held by msg, which lastMsgs
+// reads without its data. Base64 values stored without their size only
+// tell it by their padding and are read again whole.
+func (n *Nats) listedSize(nkey string, msg *nats.RawStreamMsg) (int64, error) {
+	stored, err := strconv.ParseInt(msg.Header.Get(nats.MsgSize), 10, 64)
+	if err != nil {
+		// a whole message
+		return n.valueSize(msg.Data, msg.Header), nil
+	}
+	if size, err := strconv.ParseInt(msg.Header.Get(sizeHeader), 10, 64); err == nil {
+		return size, nil
+	}
+	if n.Encoding != EncodingBase64 {
+		return stored, nil
+	}
+
+	whole, err := n.lastMsg(nkey)
+	if err != nil {
+		return 0, err
+	}
+	return n.valueSize(whole.Data, whole.Header), nil
+}
+
+// lastMsgs returns the latest message of every subject of kv matching
+// the key filter, keyed by the nats key, reading them with a single
+// ordered consumer. Only the headers are read, the size of the data is
+// in the nats.MsgSize header.
+func lastMsgs(ctx context.Context, kv nats.KeyValue, js nats.JetStreamContext, filter string) (map[string]*nats.RawStreamMsg, error) {
+	sub, err := js.SubscribeSync(kvSubject(kv, filter), nats.BindStream(kvStream(kv)), nats.OrderedConsumer(), nats.DeliverLastPerSubject(), nats.HeadersOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make(map[string]*nats.RawStreamMsg)
+	subjectPrefix := kvSubject(kv, "")
+	// messages delivered before the info was taken aren't pending
+	// anymore, the last one reports none left
+	for pending := info.NumPending + info.Delivered.Consumer; pending > 0; {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		msgs[strings.TrimPrefix(msg.Subject, subjectPrefix)] = &nats.RawStreamMsg{
+			Subject:  msg.Subject,
+			Sequence: meta.Sequence.Stream,
+			Header:   msg.Header,
+			Data:     msg.Data,
+			Time:     meta.Timestamp,
+		}
+		pending = meta.NumPending
+	}
+	return msgs, nil
+}
+
+// listInfoFrom lists and stats keys of storage which has no batched
+// metadata reads.
+func listInfoFrom(ctx context.Context, storage certmagic.Storage, prefix string, recursive bool) ([]certmagic.KeyInfo, error) {
+	keys, err := storage.List(ctx, prefix, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]certmagic.KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		ki, err := storage.Stat(ctx, key)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, ki)
+	}
+	return infos, nil
+}
@@ -0,0 +1,144 @@
+package certmagic_nats
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// memCache keeps the values of loaded keys in memory so Load and Exists
+// don't need a round trip to NATS. A watch on the bucket drops entries
+// changed by any instance. A nil cache keeps nothing.
+type memCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	// gen counts invalidations, a value fetched while it changed may
+	// already be stale and isn't cached
+	gen uint64
+
+	watcher nats.KeyWatcher
+
+	lookups cacheCounter
+}
+
+func newMemCache(enabled bool) *memCache {
+	if !enabled {
+		return nil
+	}
+	return &memCache{entries: make(map[string][]byte)}
+}
+
+// get returns a copy of the cached value of nkey.
+func (c *memCache) get(nkey string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.entries[nkey]
+	if !ok || c.watcher == nil {
+		c.lookups.lookup(false)
+		return nil, false
+	}
+	c.lookups.lookup(true)
+	return append([]byte(nil), value...), true
+}
+
+// generation returns the value to pass to put for a value fetched
+// afterwards.
+func (c *memCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches value for nkey unless an invalidation happened since gen.
+func (c *memCache) put(nkey string, value []byte, gen uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// without a watch the value wouldn't be invalidated
+	if c.gen == gen && c.watcher != nil {
+		c.entries[nkey] = append([]byte(nil), value...)
+	}
+}
+
+// invalidate drops the cached value of nkey.
+func (c *memCache) invalidate(nkey string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.entries, nkey)
+}
+
+// reset drops all cached values.
+func (c *memCache) reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[string][]byte)
+}
+
+// watch invalidates the entries of keys changed in kv, replacing the
+// watch of a previously bound bucket.
+func (c *memCache) watch(kv nats.KeyValue) error {
+	if c == nil {
+		return nil
+	}
+
+	watcher, err := kv.WatchAll(nats.UpdatesOnly(), nats.MetaOnly())
+	if err != nil {
+		return fmt.Errorf("memory cache: watch bucket %v: %w", kv.Bucket(), err)
+	}
+
+	c.mu.Lock()
+	old := c.watcher
+	c.watcher = watcher
+	c.gen++
+	c.entries = make(map[string][]byte)
+	c.mu.Unlock()
+	if old != nil {
+		old.Stop()
+	}
+
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				c.invalidate(entry.Key())
+			}
+		}
+	}()
+	return nil
+}
+
+// stop ends the watch.
+func (c *memCache) stop() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	watcher := c.watcher
+	c.watcher = nil
+	c.mu.Unlock()
+	if watcher != nil {
+		watcher.Stop()
+	}
+}
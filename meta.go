@@ -0,0 +1,118 @@
+package certmagic_nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// metaHeaderPrefix namespaces user metadata among the message headers
+const metaHeaderPrefix = "Caddy-Meta-"
+
+// StoreWithMeta stores value at key like Store and attaches meta as
+// message headers, e.g. to tag the content type of the value.
+// Metadata is replaced by every write, a plain Store drops it.
+func (n *Nats) StoreWithMeta(ctx context.Context, key string, value []byte, meta map[string]string) error {
+	n.logger.Info(fmt.Sprintf("StoreWithMeta: %v, %v bytes, %v", key, len(value), meta))
+	raw := value
+	if err := n.checkPEM(key, value); err != nil {
+		return err
+	}
+	value, hdr := n.encodeValue(value)
+	if err := n.checkWrite(key, value); err != nil {
+		return err
+	}
+
+	if hdr == nil {
+		hdr = make(nats.Header, len(meta))
+	}
+	for k, v := range meta {
+		hdr.Set(metaHeaderPrefix+k, v)
+	}
+
+	err := n.runWrite("StoreWithMeta", key, func() error {
+		_, err := n.put(key, value, 0, hdr)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	n.metrics.valueSize(len(raw))
+	n.hotCache.put(n.natsKey(key), raw)
+
+	return n.mirror("StoreWithMeta", key, func(kv nats.KeyValue, js nats.JetStreamContext) error {
+		_, err := n.putTo(kv, js, key, value, 0, hdr)
+		return err
+	})
+}
+
+// LoadMeta returns the metadata stored with key by StoreWithMeta.
+func (n *Nats) LoadMeta(ctx context.Context, key string) (map[string]string, error) {
+	n.logger.Info(fmt.Sprintf("LoadMeta: %v", key))
+	msg, err := n.loadMsg("LoadMeta", key)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]string)
+	for k := range msg.Header {
+		if strings.HasPrefix(k, metaHeaderPrefix) {
+			meta[strings.TrimPrefix(k, metaHeaderPrefix)] = msg.Header.Get(k)
+		}
+	}
+	return meta, nil
+}
+
+// LoadRegion returns the Region of the instance which stored the value
+// of key, empty if it was stored without one.
+func (n *Nats) LoadRegion(ctx context.Context, key string) (string, error) {
+	n.logger.Info(fmt.Sprintf("LoadRegion: %v", key))
+	msg, err := n.loadMsg("LoadRegion", key)
+	if err != nil {
+		return "", err
+	}
+	return msg.Header.Get(regionHeader), nil
+}
+
+// loadMsg returns the raw message holding the value of key, or
+// fs.ErrNotExist.
+func (n *Nats) loadMsg(op, key string) (*nats.RawStreamMsg, error) {
+	var msg *nats.RawStreamMsg
+	err := n.run(op, key, func() (err error) {
+		msg, err = n.lastMsg(n.natsKey(key))
+		return err
+	})
+	if isKeyNotFound(err) {
+		return nil, fs.ErrNotExist
+	}
+	return msg, err
+}
+
+// lastMsg returns the raw message holding the latest value of nkey,
+// including its headers which the kv api doesn't expose.
+func (n *Nats) lastMsg(nkey string) (*nats.RawStreamMsg, error) {
+	kv, js := n.reader()
+	return lastMsgIn(kv, js, nkey)
+}
+
+// lastMsgIn returns the raw message holding the latest value of nkey in
+// kv.
+func lastMsgIn(kv nats.KeyValue, js nats.JetStreamContext, nkey string) (*nats.RawStreamMsg, error) {
+	msg, err := storeOf(kv, js).GetLastMsg(nkey)
+	if err != nil {
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			return nil, nats.ErrKeyNotFound
+		}
+		return nil, err
+	}
+
+	switch msg.Header.Get("KV-Operation") {
+	case "DEL", "PURGE":
+		return nil, nats.ErrKeyDeleted
+	}
+	return msg, nil
+}
@@ -0,0 +1,180 @@
+package certmagic_nats
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StorageMetrics is a point in time view of the storage's activity
+// since Provision.
+type StorageMetrics struct {
+	// Operations is keyed by operation name, e.g. "Load" or "Store".
+	Operations  map[string]OperationMetrics `json:"operations"`
+	MemoryCache CacheMetrics                `json:"memory_cache"`
+	ListCache   CacheMetrics                `json:"list_cache"`
+	// HotCache counts the loads answered by this or another instance
+	// over HotCacheSubject.
+	HotCache CacheMetrics `json:"hot_cache"`
+	// ValueSizes counts the values written by Store and CompareAndSwap,
+	// by their size before encoding.
+	ValueSizes []SizeBucket `json:"value_sizes"`
+}
+
+// SizeBucket counts the values of at most Max bytes which didn't fit
+// the previous bucket. The last bucket has no limit, its Max is
+// math.MaxInt64.
+type SizeBucket struct {
+	Max   int64  `json:"max"`
+	Count uint64 `json:"count"`
+}
+
+// defaultValueSizeBuckets are used when ValueSizeBuckets isn't set,
+// from a bare certificate or key to a full chain with metadata.
+var defaultValueSizeBuckets = []int64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// OperationMetrics counts the calls of an operation which reached
+// NATS. Errors counts the calls which returned an error other than a
+// missing key.
+type OperationMetrics struct {
+	Count          uint64        `json:"count"`
+	Errors         uint64        `json:"errors"`
+	AverageLatency time.Duration `json:"average_latency"`
+}
+
+// CacheMetrics counts lookups of a cache, all zero while it's
+// disabled.
+type CacheMetrics struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// cacheCounter counts the hits and misses of a cache.
+type cacheCounter struct {
+	hits, misses atomic.Uint64
+}
+
+func (c *cacheCounter) lookup(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+func (c *cacheCounter) snapshot() CacheMetrics {
+	m := CacheMetrics{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	if total := m.Hits + m.Misses; total > 0 {
+		m.HitRate = float64(m.Hits) / float64(total)
+	}
+	return m
+}
+
+// metrics collects the operations run by Nats.run. The zero value is
+// ready to use.
+type metrics struct {
+	mu  sync.Mutex
+	ops map[string]*opCounter
+
+	sizeBounds []int64
+	sizeCounts []uint64
+}
+
+// setValueSizeBuckets replaces the upper bounds of the value size
+// histogram, which must be ascending and positive.
+func (m *metrics) setValueSizeBuckets(bounds []int64) error {
+	for i, b := range bounds {
+		if b <= 0 || (i > 0 && b <= bounds[i-1]) {
+			return fmt.Errorf("value size buckets must be positive and ascending, got %v", bounds)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sizeBounds = bounds
+	m.sizeCounts = nil
+	return nil
+}
+
+// valueSize adds a written value of size bytes to the histogram.
+func (m *metrics) valueSize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sizeCounts == nil {
+		if m.sizeBounds == nil {
+			m.sizeBounds = defaultValueSizeBuckets
+		}
+		m.sizeCounts = make([]uint64, len(m.sizeBounds)+1)
+	}
+	i, _ := slices.BinarySearch(m.sizeBounds, int64(size))
+	m.sizeCounts[i]++
+}
+
+type opCounter struct {
+	count, errors uint64
+	latency       time.Duration
+}
+
+func (m *metrics) record(op string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = make(map[string]*opCounter)
+	}
+	c, ok := m.ops[op]
+	if !ok {
+		c = &opCounter{}
+		m.ops[op] = c
+	}
+	c.count++
+	c.latency += elapsed
+	if err != nil && !isKeyNotFound(err) {
+		c.errors++
+	}
+}
+
+// MetricsSnapshot returns the operation counts, error counts, average
+// latencies, cache hit rates and value sizes collected so far. It's safe to call
+// while operations run.
+func (n *Nats) MetricsSnapshot() StorageMetrics {
+	s := StorageMetrics{Operations: make(map[string]OperationMetrics)}
+
+	n.metrics.mu.Lock()
+	for op, c := range n.metrics.ops {
+		s.Operations[op] = OperationMetrics{
+			Count:          c.count,
+			Errors:         c.errors,
+			AverageLatency: c.latency / time.Duration(c.count),
+		}
+	}
+	bounds := n.metrics.sizeBounds
+	if bounds == nil {
+		bounds = defaultValueSizeBuckets
+	}
+	for i := 0; i <= len(bounds); i++ {
+		b := SizeBucket{Max: math.MaxInt64}
+		if i < len(bounds) {
+			b.Max = bounds[i]
+		}
+		if n.metrics.sizeCounts != nil {
+			b.Count = n.metrics.sizeCounts[i]
+		}
+		s.ValueSizes = append(s.ValueSizes, b)
+	}
+	n.metrics.mu.Unlock()
+
+	if n.memCache != nil {
+		s.MemoryCache = n.memCache.lookups.snapshot()
+	}
+	if n.listCache != nil {
+		s.ListCache = n.listCache.lookups.snapshot()
+	}
+	if n.hotCache != nil {
+		s.HotCache = n.hotCache.lookups.snapshot()
+	}
+	return s
+}
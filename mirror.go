@@ -0,0 +1,89 @@
+package certmagic_nats
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// bindMirror binds MirrorBucket using js, the context of the write
+// connection.
+func (n *Nats) bindMirror(js nats.JetStreamContext) error {
+	if n.MirrorBucket == "" {
+		return nil
+	}
+
+	kv, err := js.KeyValue(n.MirrorBucket)
+	if err != nil {
+		return fmt.Errorf("mirror bucket %v: %w", n.MirrorBucket, err)
+	}
+
+	n.kvlock.Lock()
+	defer n.kvlock.Unlock()
+	n.mirrorKV, n.mirrorJS = kv, js
+	return nil
+}
+
+// readRepair loads key from the mirror bucket after its value on the
+// primary failed verification with cause, and writes the mirror's copy
+// back to the primary. cause is returned without MirrorReadRepair or
+// if the mirror has no valid copy either.
+func (n *Nats) readRepair(key string, cause error) ([]byte, error) {
+	n.kvlock.RLock()
+	kv, js := n.mirrorKV, n.mirrorJS
+	n.kvlock.RUnlock()
+	if !n.MirrorReadRepair || kv == nil {
+		return nil, cause
+	}
+
+	msg, err := lastMsgIn(kv, js, n.natsKey(key))
+	if err == nil && n.Checksum {
+		err = verifyChecksum(msg.Data, msg.Header)
+	}
+	var value []byte
+	if err == nil {
+		value, err = n.decodeValue(msg.Data)
+	}
+	if err != nil {
+		n.logger.Error(fmt.Sprintf("Read repair of %v from mirror bucket %v: %v", key, n.MirrorBucket, err))
+		return nil, cause
+	}
+
+	hdr := nats.Header{}
+	for k, v := range msg.Header {
+		if !isServerHeader(k) {
+			hdr[k] = v
+		}
+	}
+	err = n.runWrite("ReadRepair", key, func() error {
+		_, err := n.put(key, msg.Data, 0, hdr)
+		return err
+	})
+	if err != nil {
+		// the mirror's value is still good to return
+		n.logger.Error(fmt.Sprintf("Read repair of %v: writing to the primary bucket: %v", key, err))
+		return value, nil
+	}
+
+	n.logger.Warn(fmt.Sprintf("Repaired %v from mirror bucket %v after: %v", key, n.MirrorBucket, cause))
+	return value, nil
+}
+
+// mirror applies a write which succeeded on the primary bucket to the
+// mirror bucket. Failures are only logged unless MirrorRequired is set.
+func (n *Nats) mirror(op, key string, fn func(kv nats.KeyValue, js nats.JetStreamContext) error) error {
+	n.kvlock.RLock()
+	kv, js := n.mirrorKV, n.mirrorJS
+	n.kvlock.RUnlock()
+	if kv == nil {
+		return nil
+	}
+
+	if err := fn(kv, js); err != nil {
+		if n.MirrorRequired {
+			return fmt.Errorf("%s %v on mirror bucket %v: %w", op, key, n.MirrorBucket, err)
+		}
+		n.logger.Warn(fmt.Sprintf("%s %v on mirror bucket %v: %v", op, key, n.MirrorBucket, err))
+	}
+	return nil
+}
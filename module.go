@@ -1,13 +1,23 @@
 package certmagic_nats
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
 )
 
 var (
 	_ caddy.StorageConverter = (*Nats)(nil)
+	_ caddy.CleanerUpper     = (*Nats)(nil)
 	_ caddyfile.Unmarshaler  = (*Nats)(nil)
 )
 
@@ -16,23 +26,267 @@ func init() {
 }
 
 func (n *Nats) Provision(ctx caddy.Context) error {
-	n.logger = ctx.Logger(n)
+	if n.Identity == "" {
+		// a missing hostname only leaves locks without holder
+		n.Identity, _ = os.Hostname()
+	}
+	n.logger = ctx.Logger(n).With(zap.String("identity", n.Identity))
+	n.caddyCtx = ctx
+
+	if err := n.loadContext(); err != nil {
+		return err
+	}
 
 	if n.InboxPrefix == "" {
 		n.InboxPrefix = "_INBOX"
 	}
 
-	kv, err := connectNats(n.Hosts, n.Creds, n.Bucket, n.ConnectionName, n.InboxPrefix)
-	if err != nil {
+	if err := validateEncoding(n.Encoding); err != nil {
+		return err
+	}
+
+	if err := validateCompression(n.Compression); err != nil {
+		return err
+	}
+
+	if n.CASWrites && n.AsyncWrites {
+		return fmt.Errorf("cas_writes can't be combined with async_writes")
+	}
+
+	switch n.ListFormat {
+	case "", ListFormatCertmagic, ListFormatNats:
+	default:
+		return fmt.Errorf("unknown list_format %q, must be %q or %q", n.ListFormat, ListFormatCertmagic, ListFormatNats)
+	}
+
+	if n.LockNamespace != "" && !validLockNamespace.MatchString(n.LockNamespace) {
+		return fmt.Errorf("invalid lock_namespace %q, must be a single nats subject token", n.LockNamespace)
+	}
+
+	if n.DedupWindow < 0 {
+		return fmt.Errorf("invalid dedup_window %v, must not be negative", time.Duration(n.DedupWindow))
+	}
+	if n.ReadRetries < 0 {
+		return fmt.Errorf("invalid read_retries %d, must not be negative", n.ReadRetries)
+	}
+	if n.MinAccountStorage < 0 {
+		return fmt.Errorf("invalid min_account_storage %d, must not be negative", n.MinAccountStorage)
+	}
+	n.KeyPrefix = n.canonicalKey(strings.Trim(n.KeyPrefix, "/"))
+	if n.KeyPrefix != "" && !wellFormedKey(n.KeyPrefix) {
+		return fmt.Errorf("invalid key_prefix %q", n.KeyPrefix)
+	}
+
+	if n.MaxKeyTokens < 0 {
+		return fmt.Errorf("invalid max_key_tokens %d, must not be negative", n.MaxKeyTokens)
+	}
+	if strings.ContainsAny(n.HotCacheSubject, "*> ") {
+		return fmt.Errorf("invalid hot_cache_subject %q, must not contain wildcards or spaces", n.HotCacheSubject)
+	}
+	if n.HotCacheSize < 0 {
+		return fmt.Errorf("invalid hot_cache_size %d, must not be negative", n.HotCacheSize)
+	}
+
+	switch n.InvalidKeys {
+	case "", InvalidKeysSkip, InvalidKeysError, InvalidKeysKeep:
+	default:
+		return fmt.Errorf("unknown invalid_keys %q, must be %q, %q or %q", n.InvalidKeys, InvalidKeysSkip, InvalidKeysError, InvalidKeysKeep)
+	}
+
+	if n.ValueSizeBuckets != nil {
+		if err := n.metrics.setValueSizeBuckets(n.ValueSizeBuckets); err != nil {
+			return err
+		}
+	}
+
+	if err := n.validateBucketConfig(); err != nil {
+		return err
+	}
+
+	if n.JWTProvider != nil && n.JWTSigner == nil && n.Creds == "" {
+		return fmt.Errorf("a jwt provider requires a jwt signer or creds holding the nkey seed")
+	}
+
+	if err := n.validateAccount(); err != nil {
+		return err
+	}
+
+	if err := n.validateTLS(); err != nil {
+		return err
+	}
+
+	if err := n.validateKeyHooks(); err != nil {
 		return err
 	}
 
+	if n.FallbackRaw != nil {
+		mod, err := ctx.LoadModule(n, "FallbackRaw")
+		if err != nil {
+			return fmt.Errorf("loading fallback storage module: %v", err)
+		}
+		fallback, err := mod.(caddy.StorageConverter).CertMagicStorage()
+		if err != nil {
+			return fmt.Errorf("creating fallback storage: %v", err)
+		}
+		n.Fallback = fallback
+	}
+
 	n.revMap = make(map[string]uint64)
+	n.breaker = newBreaker(n.BreakerThreshold, time.Duration(n.BreakerCooldown))
+	n.readOnly = newReadOnly(n.ReadOnlyAfter, time.Duration(n.ReadOnlyProbeInterval))
+	n.listCache = newListCache(time.Duration(n.ListCacheTTL))
+	n.memCache = newMemCache(n.MemoryCache)
+	n.hotCache = newHotCache(n.HotCacheSubject, n.Bucket, time.Duration(n.HotCacheTimeout), n.HotCacheSize)
+	n.webhooks = newWebhooks(n.Webhooks, time.Duration(n.WebhookInterval), n.logger)
+
+	nc, err := n.connectWithRetry(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n.RequireEmptyBucket {
+		if err := n.checkEmptyBucket(); err != nil {
+			nc.Close()
+			return err
+		}
+	}
+
+	if err := n.checkAccountStorage(); err != nil {
+		nc.Close()
+		return err
+	}
+
+	if max := nc.MaxPayload(); max > 0 && (n.MaxPayload <= 0 || n.MaxPayload > max) {
+		n.MaxPayload = max
+	}
+
+	if hosts, creds, bucket, ok := n.readTarget(); ok {
+		rnc, err := n.connect(hosts, creds, bucket, true)
+		if err != nil {
+			nc.Close()
+			return fmt.Errorf("read connection: %w", err)
+		}
+		n.readConn = rnc
+	}
+
+	if kv, _ := n.reader(); kv != nil {
+		if err := n.memCache.watch(kv); err != nil {
+			nc.Close()
+			if n.readConn != nil {
+				n.readConn.Close()
+			}
+			return err
+		}
+	}
+
+	n.nativeTTL = n.detectNativeTTL(nc)
+	if n.nativeTTL {
+		n.logger.Info("Server supports message TTLs, locks expire natively")
+	}
+
+	if err := n.hotCache.bind(nc); err != nil {
+		n.memCache.stop()
+		nc.Close()
+		if n.readConn != nil {
+			n.readConn.Close()
+		}
+		return err
+	}
 
-	n.Client = kv
+	n.conn = nc
+	n.startKeepalive()
+	n.startIdle()
+	n.startFailover()
+	n.startCompaction()
+	n.logger.Debug(fmt.Sprintf("Resolved config: %v", n.ResolvedConfig()))
 	return nil
 }
 
+// readTarget returns where the read connection goes, ok is false
+// without one. Unset read settings fall back to the primary ones.
+func (n *Nats) readTarget() (hosts, creds, bucket string, ok bool) {
+	if n.ReadHosts == "" && n.ReadCreds == "" && n.ReadBucket == "" {
+		return "", "", "", false
+	}
+
+	hosts, creds, bucket = n.ReadHosts, n.ReadCreds, n.ReadBucket
+	if hosts == "" {
+		hosts = n.Hosts
+	}
+	if creds == "" {
+		creds = n.Creds
+	}
+	if bucket == "" {
+		bucket = n.Bucket
+	}
+	return hosts, creds, bucket, true
+}
+
+// provisionDeadline bounds the time Provision spends retrying the
+// initial connection.
+const provisionDeadline = 5 * time.Minute
+
+// connectWithRetry makes the initial connection, retrying up to
+// ProvisionRetries times in case NATS isn't up yet.
+func (n *Nats) connectWithRetry(ctx caddy.Context) (*nats.Conn, error) {
+	var done <-chan struct{}
+	if ctx.Context != nil {
+		done = ctx.Done()
+	}
+
+	deadline := time.Now().Add(provisionDeadline)
+	for attempt := 0; ; attempt++ {
+		nc, err := n.connect(n.Hosts, n.Creds, n.Bucket, false)
+		if err == nil || attempt >= n.ProvisionRetries {
+			return nc, err
+		}
+
+		wait := time.Duration(n.ProvisionRetryWait)
+		if wait <= 0 {
+			wait = time.Second
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, fmt.Errorf("giving up connecting after %v: %w", provisionDeadline, err)
+		}
+
+		n.logger.Warn(fmt.Sprintf("Connecting failed, retrying in %v (%d/%d): %v", wait, attempt+1, n.ProvisionRetries, err))
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return nil, err
+		}
+	}
+}
+
+// Cleanup waits for pending async writes and drains the connections.
+func (n *Nats) Cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if n.ReleaseLocksOnCleanup {
+		n.releaseHeldLocks(ctx)
+	}
+	err := n.Flush(ctx)
+	n.cleanupTenants()
+	n.stopCompaction()
+	n.stopFailover()
+	n.stopKeepalive()
+	n.stopIdle()
+	n.memCache.stop()
+	n.hotCache.stop()
+	n.webhooks.stop()
+
+	// draining lets in-flight requests finish, operations started in
+	// the meantime fail with ErrDraining
+	nc, rnc := n.conns()
+	if rnc != nil {
+		rnc.Drain()
+	}
+	if nc != nil {
+		nc.Drain()
+	}
+	return err
+}
+
 func (n *Nats) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		var value string
@@ -53,6 +307,401 @@ func (n *Nats) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			n.InboxPrefix = value
 		case "connection_name":
 			n.ConnectionName = value
+		case "advertise_version":
+			advertise, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid advertise_version %q: %v", value, err)
+			}
+			n.AdvertiseVersion = advertise
+		case "cert_file":
+			n.CertFile = value
+		case "key_file":
+			n.KeyFile = value
+		case "ca_file":
+			n.CAFile = value
+		case "context":
+			n.Context = value
+		case "tls_first":
+			first, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid tls_first %q: %v", value, err)
+			}
+			n.TLSFirst = first
+		case "websocket_path":
+			n.WebsocketPath = value
+		case "wire_compression":
+			compress, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid wire_compression %q: %v", value, err)
+			}
+			n.WireCompression = compress
+		case "account":
+			n.Account = value
+		case "max_payload":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return d.Errf("invalid max_payload %q: %v", value, err)
+			}
+			n.MaxPayload = size
+		case "max_key_tokens":
+			tokens, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid max_key_tokens %q: %v", value, err)
+			}
+			n.MaxKeyTokens = tokens
+		case "encoding":
+			n.Encoding = value
+		case "republish_subject":
+			n.RepublishSubject = value
+		case "stream_replicas":
+			replicas, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid stream_replicas %q: %v", value, err)
+			}
+			n.StreamReplicas = replicas
+		case "stream_retention":
+			n.StreamRetention = value
+		case "stream_discard":
+			n.StreamDiscard = value
+		case "stream_max_msgs_per_subject":
+			limit, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return d.Errf("invalid stream_max_msgs_per_subject %q: %v", value, err)
+			}
+			n.StreamMaxMsgsPerSubject = limit
+		case "stream_max_bytes":
+			limit, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return d.Errf("invalid stream_max_bytes %q: %v", value, err)
+			}
+			n.StreamMaxBytes = limit
+		case "compression":
+			n.Compression = value
+		case "checksum":
+			checksum, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid checksum %q: %v", value, err)
+			}
+			n.Checksum = checksum
+		case "exists_meta_only":
+			metaOnly, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid exists_meta_only %q: %v", value, err)
+			}
+			n.ExistsMetaOnly = metaOnly
+		case "validate_pem":
+			validate, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid validate_pem %q: %v", value, err)
+			}
+			n.ValidatePEM = validate
+		case "key_prefix":
+			n.KeyPrefix = value
+		case "obfuscate_keys_secret":
+			n.ObfuscateKeysSecret = value
+		case "bucket_context_key":
+			n.BucketContextKey = value
+		case "hash_keys_longer_than":
+			length, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid hash_keys_longer_than %q: %v", value, err)
+			}
+			n.HashKeysLongerThan = length
+		case "mirror_bucket":
+			n.MirrorBucket = value
+		case "mirror_required":
+			required, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid mirror_required %q: %v", value, err)
+			}
+			n.MirrorRequired = required
+		case "fallback_to_previous_revision":
+			fallback, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid fallback_to_previous_revision %q: %v", value, err)
+			}
+			n.FallbackToPreviousRevision = fallback
+		case "mirror_read_repair":
+			repair, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid mirror_read_repair %q: %v", value, err)
+			}
+			n.MirrorReadRepair = repair
+		case "dedup_window":
+			window, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid dedup_window %q: %v", value, err)
+			}
+			n.DedupWindow = caddy.Duration(window)
+		case "read_retries":
+			retries, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid read_retries %q: %v", value, err)
+			}
+			n.ReadRetries = retries
+		case "provision_retries":
+			retries, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid provision_retries %q: %v", value, err)
+			}
+			n.ProvisionRetries = retries
+		case "provision_retry_wait":
+			wait, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid provision_retry_wait %q: %v", value, err)
+			}
+			n.ProvisionRetryWait = caddy.Duration(wait)
+		case "reconnect_buf_size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid reconnect_buf_size %q: %v", value, err)
+			}
+			n.ReconnectBufSize = size
+		case "failover_after":
+			after, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid failover_after %q: %v", value, err)
+			}
+			n.FailoverAfter = caddy.Duration(after)
+		case "webhook":
+			n.Webhooks = append(n.Webhooks, value)
+		case "webhook_interval":
+			interval, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid webhook_interval %q: %v", value, err)
+			}
+			n.WebhookInterval = caddy.Duration(interval)
+		case "ping_interval":
+			interval, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid ping_interval %q: %v", value, err)
+			}
+			n.PingInterval = caddy.Duration(interval)
+		case "keepalive":
+			interval, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid keepalive %q: %v", value, err)
+			}
+			n.Keepalive = caddy.Duration(interval)
+		case "idle_timeout":
+			timeout, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid idle_timeout %q: %v", value, err)
+			}
+			n.IdleTimeout = caddy.Duration(timeout)
+		case "reconnect_jitter":
+			jitter, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid reconnect_jitter %q: %v", value, err)
+			}
+			n.ReconnectJitter = caddy.Duration(jitter)
+		case "reconnect_jitter_tls":
+			jitter, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid reconnect_jitter_tls %q: %v", value, err)
+			}
+			n.ReconnectJitterTLS = caddy.Duration(jitter)
+		case "watch_durable":
+			n.WatchDurable = value
+		case "watch_deliver_policy":
+			n.WatchDeliverPolicy = value
+		case "watch_ack_policy":
+			n.WatchAckPolicy = value
+		case "sub_pending_msgs_limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid sub_pending_msgs_limit %q: %v", value, err)
+			}
+			n.SubPendingMsgsLimit = limit
+		case "sub_pending_bytes_limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid sub_pending_bytes_limit %q: %v", value, err)
+			}
+			n.SubPendingBytesLimit = limit
+		case "cas_writes":
+			cas, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid cas_writes %q: %v", value, err)
+			}
+			n.CASWrites = cas
+		case "soft_delete":
+			soft, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid soft_delete %q: %v", value, err)
+			}
+			n.SoftDelete = soft
+		case "soft_delete_window":
+			window, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid soft_delete_window %q: %v", value, err)
+			}
+			n.SoftDeleteWindow = caddy.Duration(window)
+		case "compact_interval":
+			interval, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid compact_interval %q: %v", value, err)
+			}
+			n.CompactInterval = caddy.Duration(interval)
+		case "compact_marker_age":
+			age, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid compact_marker_age %q: %v", value, err)
+			}
+			n.CompactMarkerAge = caddy.Duration(age)
+		case "region":
+			n.Region = value
+		case "identity":
+			n.Identity = value
+		case "max_held_locks":
+			max, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid max_held_locks %q: %v", value, err)
+			}
+			n.MaxHeldLocks = max
+		case "release_locks_on_cleanup":
+			release, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid release_locks_on_cleanup %q: %v", value, err)
+			}
+			n.ReleaseLocksOnCleanup = release
+		case "lock_namespace":
+			n.LockNamespace = value
+		case "lock_stale_grace":
+			grace, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid lock_stale_grace %q: %v", value, err)
+			}
+			n.LockStaleGrace = caddy.Duration(grace)
+		case "async_writes":
+			async, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid async_writes %q: %v", value, err)
+			}
+			n.AsyncWrites = async
+		case "lowercase_keys":
+			lower, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid lowercase_keys %q: %v", value, err)
+			}
+			n.LowercaseKeys = lower
+		case "raw_keys":
+			raw, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid raw_keys %q: %v", value, err)
+			}
+			n.RawKeys = raw
+		case "require_empty_bucket":
+			empty, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid require_empty_bucket %q: %v", value, err)
+			}
+			n.RequireEmptyBucket = empty
+		case "min_account_storage":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return d.Errf("invalid min_account_storage %q: %v", value, err)
+			}
+			n.MinAccountStorage = size
+		case "require_account_storage":
+			require, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid require_account_storage %q: %v", value, err)
+			}
+			n.RequireAccountStorage = require
+		case "read_hosts":
+			n.ReadHosts = value
+		case "read_creds":
+			n.ReadCreds = value
+		case "read_bucket":
+			n.ReadBucket = value
+		case "memory_cache":
+			cache, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid memory_cache %q: %v", value, err)
+			}
+			n.MemoryCache = cache
+		case "hot_cache_subject":
+			n.HotCacheSubject = value
+		case "hot_cache_timeout":
+			timeout, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid hot_cache_timeout %q: %v", value, err)
+			}
+			n.HotCacheTimeout = caddy.Duration(timeout)
+		case "hot_cache_size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid hot_cache_size %q: %v", value, err)
+			}
+			n.HotCacheSize = size
+		case "list_format":
+			n.ListFormat = value
+		case "invalid_keys":
+			n.InvalidKeys = value
+		case "list_cache_ttl":
+			ttl, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid list_cache_ttl %q: %v", value, err)
+			}
+			n.ListCacheTTL = caddy.Duration(ttl)
+		case "list_limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid list_limit %q: %v", value, err)
+			}
+			n.ListLimit = limit
+		case "value_size_buckets":
+			n.ValueSizeBuckets = nil
+			for _, s := range strings.Split(value, ",") {
+				size, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+				if err != nil {
+					return d.Errf("invalid value_size_buckets %q: %v", value, err)
+				}
+				n.ValueSizeBuckets = append(n.ValueSizeBuckets, size)
+			}
+		case "list_batch_size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid list_batch_size %q: %v", value, err)
+			}
+			n.ListBatchSize = size
+		case "list_missing_is_error":
+			missing, err := strconv.ParseBool(value)
+			if err != nil {
+				return d.Errf("invalid list_missing_is_error %q: %v", value, err)
+			}
+			n.ListMissingIsError = missing
+		case "slow_op_threshold":
+			threshold, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid slow_op_threshold %q: %v", value, err)
+			}
+			n.SlowOpThreshold = caddy.Duration(threshold)
+		case "breaker_threshold":
+			threshold, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid breaker_threshold %q: %v", value, err)
+			}
+			n.BreakerThreshold = threshold
+		case "read_only_after":
+			after, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid read_only_after %q: %v", value, err)
+			}
+			n.ReadOnlyAfter = after
+		case "read_only_probe_interval":
+			interval, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid read_only_probe_interval %q: %v", value, err)
+			}
+			n.ReadOnlyProbeInterval = caddy.Duration(interval)
+		case "breaker_cooldown":
+			cooldown, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid breaker_cooldown %q: %v", value, err)
+			}
+			n.BreakerCooldown = caddy.Duration(cooldown)
 		}
 	}
 
@@ -2,19 +2,27 @@ package certmagic_nats
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"math/rand"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/certmagic"
 	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -28,16 +36,583 @@ type Nats struct {
 	InboxPrefix    string `json:"inbox_prefix"`
 	ConnectionName string `json:"connection_name"`
 
+	// AdvertiseVersion appends the module version, derived from the
+	// build info, to the connection name, e.g. "caddy
+	// caddy-nats-storage/v0.3.0", so server connection listings and
+	// monitoring show which clients still need an upgrade.
+	AdvertiseVersion bool `json:"advertise_version,omitempty"`
+
+	// JWTProvider returns the user JWT sent on every connect and
+	// reconnect, e.g. fetched from a sidecar issuing short lived JWTs,
+	// instead of the one in Creds. The server nonce is signed by
+	// JWTSigner, or with the nkey seed in Creds when it's nil.
+	JWTProvider func() (string, error)       `json:"-"`
+	JWTSigner   func([]byte) ([]byte, error) `json:"-"`
+
+	// Context names a nats cli context, e.g. "prod" for
+	// ~/.config/nats/context/prod.json, or is the path of a context
+	// file. Its url, creds and TLS settings are used where the
+	// corresponding fields are unset.
+	Context string `json:"context,omitempty"`
+
+	// CertFile and KeyFile are the client certificate used for mTLS.
+	// They are read again on every handshake to pick up rotations.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// CAFile verifies the server certificate instead of the system
+	// roots.
+	CAFile string `json:"ca_file,omitempty"`
+
+	// TLSFirst performs the TLS handshake before the server sends its
+	// INFO, for servers configured with handshake_first.
+	TLSFirst bool `json:"tls_first,omitempty"`
+
+	// WebsocketPath is added to the URL of ws:// and wss:// hosts, for
+	// servers reached through a proxy under a path. The TLS settings
+	// above apply to wss:// hosts as well, except TLSFirst: websocket
+	// connections always start with the TLS handshake.
+	WebsocketPath string `json:"websocket_path,omitempty"`
+
+	// WireCompression asks the server to compress traffic on the
+	// connection. nats.go only supports this for WebSocket (ws:// and
+	// wss://) hosts, on servers with websocket compression enabled.
+	WireCompression bool `json:"wire_compression,omitempty"`
+
+	// Account is the public key of the account Creds must belong to.
+	// On servers hosting multiple accounts this guards against
+	// connecting with credentials of the wrong tenant.
+	Account string `json:"account,omitempty"`
+
+	// MaxPayload caps the size of a stored value in bytes. When unset
+	// or larger than the limit announced by the server, the server's
+	// limit is used.
+	MaxPayload int64 `json:"max_payload,omitempty"`
+
+	// MaxKeyTokens caps the number of subject tokens a normalized key
+	// may have, for servers built or configured with a lower limit.
+	// Servers don't announce their limit, so when zero the default of
+	// 256 is used.
+	MaxKeyTokens int `json:"max_key_tokens,omitempty"`
+
+	// Encoding selects how values are stored in the bucket, either
+	// "raw" (the default) or "base64".
+	Encoding string `json:"encoding,omitempty"`
+
+	// Compression compresses values before they are stored, "gzip" is
+	// supported. Values stored uncompressed still load once it's enabled.
+	Compression string `json:"compression,omitempty"`
+
+	// DefaultsFor maps key prefixes to a value Load returns instead of
+	// fs.ErrNotExist for missing keys below them. The longest matching
+	// prefix wins.
+	DefaultsFor map[string][]byte `json:"defaults_for,omitempty"`
+
+	// Checksum stores a SHA-256 of every value in a header and verifies
+	// it on Load, failing with ErrChecksumMismatch on corruption.
+	Checksum bool `json:"checksum,omitempty"`
+
+	// ExistsMetaOnly has Exists read only the headers of the latest
+	// revision instead of getting the value, saving the transfer of
+	// large values at the cost of a consumer created per call.
+	ExistsMetaOnly bool `json:"exists_meta_only,omitempty"`
+
+	// ValidatePEM rejects Stores of keys ending in .crt, .key or .pem
+	// whose value isn't made of PEM blocks with ErrInvalidPEM, catching
+	// upstream bugs before they are persisted. Other keys are stored
+	// unchecked.
+	ValidatePEM bool `json:"validate_pem,omitempty"`
+
+	// HashKeysLongerThan stores keys whose normalized form is longer
+	// than this many characters under a fixed length hash. The original
+	// key is kept in a message header so List can still return it.
+	// Disabled when zero.
+	HashKeysLongerThan int `json:"hash_keys_longer_than,omitempty"`
+
+	// KeyPrefix stores all keys below this prefix, e.g. to share a
+	// bucket between configs, and strips it from listed keys. Locks
+	// aren't prefixed, LockNamespace separates them.
+	KeyPrefix string `json:"key_prefix,omitempty"`
+
+	// ObfuscateKeysSecret replaces the domain names and email addresses
+	// in keys with an HMAC under this secret, so subjects seen by other
+	// tenants of a shared cluster don't reveal the domains. As with
+	// hashed keys the original key is kept in a message header for
+	// List, it's visible to whoever can read the bucket. Changing the
+	// secret orphans the stored keys.
+	ObfuscateKeysSecret string `json:"obfuscate_keys_secret,omitempty"`
+
+	// LowercaseKeys lowercases the domain name parts of keys on reads
+	// and writes, so lookups match regardless of the domain's case.
+	// Key segments which don't look like a domain are left as is, as
+	// are the ACME accounts below acme/<issuer>/users.
+	LowercaseKeys bool `json:"lowercase_keys,omitempty"`
+
+	// RawKeys stores keys verbatim instead of converting the slash
+	// separated certmagic keys to dotted nats keys. Keys must then be
+	// valid nats subjects, e.g. already encoded by the caller.
+	RawKeys bool `json:"raw_keys,omitempty"`
+
+	// KeyEncode and KeyDecode rewrite keys before they are normalized
+	// and after they are denormalized, e.g. to strip an internal prefix.
+	// They must be exact inverses, which Provision checks.
+	KeyEncode func(string) string `json:"-"`
+	KeyDecode func(string) string `json:"-"`
+
+	// ReadHosts, ReadCreds and ReadBucket configure a separate
+	// connection used by Load, List, Stat and Exists, e.g. to serve
+	// reads from a replicated secondary. Unset fields fall back to
+	// their write counterparts; without any of them a single
+	// connection is used.
+	ReadHosts  string `json:"read_hosts,omitempty"`
+	ReadCreds  string `json:"read_creds,omitempty"`
+	ReadBucket string `json:"read_bucket,omitempty"`
+
+	conn *nats.Conn
+	js   nats.JetStreamContext
+
+	// nativeTTL is set when the server expires locks by itself
+	nativeTTL bool
+
+	mirrorKV nats.KeyValue
+	mirrorJS nats.JetStreamContext
+
+	readConn   *nats.Conn
+	readJS     nats.JetStreamContext
+	readClient nats.KeyValue
+
+	// MirrorBucket receives a copy of every write and delete of a key,
+	// e.g. for disaster recovery. Mirror failures are logged, unless
+	// MirrorRequired is set and they fail the write. Reads only use the
+	// primary bucket, unless MirrorReadRepair is set: then a value
+	// failing its checksum or decoding on the primary is loaded from
+	// the mirror and written back to the primary.
+	MirrorBucket     string `json:"mirror_bucket,omitempty"`
+	MirrorRequired   bool   `json:"mirror_required,omitempty"`
+	MirrorReadRepair bool   `json:"mirror_read_repair,omitempty"`
+
+	// FallbackToPreviousRevision has Load serve the most recent earlier
+	// revision of a key whose latest value fails its checksum or
+	// decoding, e.g. after a partially failed write, instead of failing.
+	// It is tried after MirrorReadRepair and needs a bucket history
+	// above 1.
+	FallbackToPreviousRevision bool `json:"fallback_to_previous_revision,omitempty"`
+
+	// ProvisionRetries retries the initial connection in Provision,
+	// waiting ProvisionRetryWait (default 1s) between attempts, for
+	// deployments where NATS may start after Caddy. Retrying stops
+	// after 5 minutes in total.
+	ProvisionRetries   int            `json:"provision_retries,omitempty"`
+	ProvisionRetryWait caddy.Duration `json:"provision_retry_wait,omitempty"`
+
+	// DedupWindow has Store set a message id derived from the key and
+	// value, so the server drops identical Stores within the duplicate
+	// window of the bucket, e.g. repeated by retries. Buckets created
+	// from BucketConfig get this window, existing ones keep theirs, two
+	// minutes by default. A value the key held earlier in the window
+	// that was overwritten since is written again without the id. Not
+	// applied to AsyncWrites, whose acks can't be checked in order.
+	DedupWindow caddy.Duration `json:"dedup_window,omitempty"`
+
+	// ReadRetries retries Load, Exists and Stat this many times while
+	// they fail with a timeout or no responders, reads are safe to
+	// repeat. Writes are only retried on no responders, when they
+	// can't have been applied.
+	ReadRetries int `json:"read_retries,omitempty"`
+
+	// ReconnectBufSize is how many bytes of writes are buffered while
+	// reconnecting, 8MB by default and -1 to fail writes immediately. A
+	// buffered Store only returns once the server acknowledged it after
+	// the reconnect, or fails when the acknowledgement times out, so a
+	// successful Store is always persisted.
+	ReconnectBufSize int `json:"reconnect_buf_size,omitempty"`
+
+	// Failover lists buckets, e.g. on a DR cluster, to switch to in
+	// order once the active one was unavailable for FailoverAfter
+	// (default 30s). Reads and writes follow the active bucket; after
+	// the last target the primary is tried again.
+	Failover      []FailoverTarget `json:"failover,omitempty"`
+	FailoverAfter caddy.Duration   `json:"failover_after,omitempty"`
+
+	// Webhooks are URLs a WebhookEvent is POSTed to on connects,
+	// disconnects, reconnects and failed JetStream operations. Events
+	// are sent in the background, each kind at most once per
+	// WebhookInterval (default 10s).
+	Webhooks        []string       `json:"webhooks,omitempty"`
+	WebhookInterval caddy.Duration `json:"webhook_interval,omitempty"`
+
+	// PingInterval is how often nats.go pings the server to detect a
+	// dead connection, 2m by default. Keepalive additionally flushes
+	// the connections whenever no operation ran for that long, for
+	// networks dropping idle connections. Disabled when zero.
+	PingInterval caddy.Duration `json:"ping_interval,omitempty"`
+	Keepalive    caddy.Duration `json:"keepalive,omitempty"`
+
+	// IdleTimeout closes the connections once no operation ran for
+	// this long, for bursty workloads idling most of the time. The
+	// next operation reconnects first. Disabled when zero.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	// ReconnectJitter and ReconnectJitterTLS add up to this much random
+	// delay to reconnect attempts on plain and TLS connections, so
+	// instances don't all reconnect at once when a server fails. They
+	// default to 100ms and 1s.
+	ReconnectJitter    caddy.Duration `json:"reconnect_jitter,omitempty"`
+	ReconnectJitterTLS caddy.Duration `json:"reconnect_jitter_tls,omitempty"`
+
+	// AsyncWrites makes Store return without waiting for the server
+	// to acknowledge the write. Use Flush to wait for pending writes,
+	// StoreR reports a zero revision for them.
+	AsyncWrites bool `json:"async_writes,omitempty"`
+
+	// CASWrites makes Store fail with ErrConcurrentModification if the
+	// key was written elsewhere since this instance loaded or stored it,
+	// instead of silently overwriting the other write.
+	CASWrites bool `json:"cas_writes,omitempty"`
+
+	// SoftDelete makes Delete keep the value in a tombstone marked with
+	// the time of deletion, from which Undelete can restore it for
+	// SoftDeleteWindow (forever when zero). Soft deleted keys are gone
+	// for Load and List like deleted ones; DeleteOlderThan with the
+	// prefix "TOMBSTONE" prunes old tombstones. The prefix is reserved
+	// while SoftDelete is set, storing below it fails.
+	SoftDelete       bool           `json:"soft_delete,omitempty"`
+	SoftDeleteWindow caddy.Duration `json:"soft_delete_window,omitempty"`
+
+	// Identity names this instance as the holder of its locks and in
+	// its logs, defaulting to the hostname.
+	Identity string `json:"identity,omitempty"`
+
+	// Region is attached to every stored value as a message header, so
+	// LoadRegion tells which region wrote it, e.g. when debugging
+	// conflicting writes of a multi-region deployment.
+	Region string `json:"region,omitempty"`
+
+	// CompactInterval runs Compact in the background this often, plus
+	// a random jitter. Disabled when zero. CompactMarkerAge keeps delete
+	// markers younger than this so watchers still see the deletes,
+	// 30m by default and none when negative.
+	CompactInterval  caddy.Duration `json:"compact_interval,omitempty"`
+	CompactMarkerAge caddy.Duration `json:"compact_marker_age,omitempty"`
+
+	// LockStaleGrace is waited on top of the lock expiry before another
+	// instance takes over a lock, so clock skew between instances
+	// doesn't end locks early. It should be larger than the expected
+	// skew.
+	LockStaleGrace caddy.Duration `json:"lock_stale_grace,omitempty"`
+
+	// LockNamespace separates the locks of instances sharing a bucket,
+	// e.g. one per ACME CA or cluster, so they don't contend on the same
+	// lock keys. It must be a single subject token.
+	LockNamespace string `json:"lock_namespace,omitempty"`
+
+	// MaxHeldLocks fails Lock with ErrTooManyLocks while the instance
+	// holds this many locks, guarding against a config acquiring locks
+	// without bound. 1024 when zero.
+	MaxHeldLocks int `json:"max_held_locks,omitempty"`
+
+	// ReleaseLocksOnCleanup unlocks the locks the instance still holds
+	// in Cleanup, so other instances don't wait for them to expire
+	// after a clean shutdown. Caddy also cleans up on config reloads,
+	// while operations of the old config may still run under the
+	// locks, so it's off by default.
+	ReleaseLocksOnCleanup bool `json:"release_locks_on_cleanup,omitempty"`
+
+	// WatchDurable, WatchDeliverPolicy and WatchAckPolicy configure
+	// the JetStream consumer created by Subscribe. Without a durable
+	// name an ephemeral consumer is used; the deliver policy is one of
+	// "all", "last", "new" (default) or "last_per_subject", the ack
+	// policy one of "none" (default), "all" or "explicit".
+	WatchDurable       string `json:"watch_durable,omitempty"`
+	WatchDeliverPolicy string `json:"watch_deliver_policy,omitempty"`
+	WatchAckPolicy     string `json:"watch_ack_policy,omitempty"`
+
+	// SubPendingMsgsLimit and SubPendingBytesLimit bound the messages
+	// buffered by the client for the Subscribe subscription before it
+	// is considered a slow consumer. Zero keeps the nats.go defaults;
+	// the watchers used internally by nats.go's KeyValue can't be tuned.
+	SubPendingMsgsLimit  int `json:"sub_pending_msgs_limit,omitempty"`
+	SubPendingBytesLimit int `json:"sub_pending_bytes_limit,omitempty"`
+
+	// BucketConfig is used to create the bucket if it doesn't exist,
+	// allowing custom layouts like mirrors or sources. Its bucket name
+	// must match Bucket.
+	BucketConfig *nats.KeyValueConfig `json:"bucket_config,omitempty"`
+
+	// BucketContextKey routes Lock, Unlock, Store, Load, Delete,
+	// Exists, List and Stat to the bucket named by the string stored
+	// in the operation's context under caddy.CtxKey(BucketContextKey),
+	// e.g. a tenant id. Operations without it use Bucket. The other
+	// buckets must exist or are created from BucketConfig.
+	BucketContextKey string `json:"bucket_context_key,omitempty"`
+
+	// Placement pins the bucket created from BucketConfig to a cluster
+	// or to servers with the given tags.
+	Placement *nats.Placement `json:"placement,omitempty"`
+
+	// RepublishSubject has the bucket created from BucketConfig
+	// republish every change to this subject, e.g. "certs.>" to keep
+	// the key in the subject. It has no effect on existing buckets.
+	RepublishSubject string `json:"republish_subject,omitempty"`
+
+	// RequireEmptyBucket fails Provision if the bucket already holds
+	// keys, to catch accidentally sharing a bucket on a fresh deploy.
+	RequireEmptyBucket bool `json:"require_empty_bucket,omitempty"`
+
+	// MinAccountStorage is the JetStream storage in bytes the account
+	// must have left at startup, below it Provision logs a warning, or
+	// fails with RequireAccountStorage. Accounts without a limit always
+	// pass.
+	MinAccountStorage     int64 `json:"min_account_storage,omitempty"`
+	RequireAccountStorage bool  `json:"require_account_storage,omitempty"`
+
+	// StreamReplicas, StreamRetention and StreamDiscard tune the stream
+	// backing a bucket created from BucketConfig. Buckets only work with
+	// the "limits" retention, the discard policy is "new" (the default)
+	// or "old".
+	StreamReplicas  int    `json:"stream_replicas,omitempty"`
+	StreamRetention string `json:"stream_retention,omitempty"`
+	StreamDiscard   string `json:"stream_discard,omitempty"`
+
+	// StreamMaxMsgsPerSubject and StreamMaxBytes cap the revisions kept
+	// per key and the bytes kept overall, setting the history and max
+	// bytes of BucketConfig. Once StreamMaxBytes is reached writes fail
+	// with the "new" discard policy, with "old" the oldest revisions are
+	// dropped, which may be the only revision of a key.
+	StreamMaxMsgsPerSubject int64 `json:"stream_max_msgs_per_subject,omitempty"`
+	StreamMaxBytes          int64 `json:"stream_max_bytes,omitempty"`
+
+	// MemoryCache serves Load and Exists of keys loaded before from
+	// memory, e.g. to keep NATS round trips out of TLS handshakes.
+	// Writes still go to NATS, a watch on the bucket drops cached
+	// values changed by any instance.
+	MemoryCache bool `json:"memory_cache,omitempty"`
+
+	// HotCacheSubject enables serving the values this instance wrote
+	// recently to other instances on the same bucket over core NATS
+	// request-reply on subjects below <subject>.<bucket>, so a freshly
+	// issued certificate doesn't need a JetStream round trip
+	// everywhere. Load falls back to the bucket right away when no
+	// instance holds the key, or when none answers within
+	// HotCacheTimeout (default 20ms). Writes and deletes invalidate the
+	// value on all instances. Values are sent decoded, the subjects must
+	// be closed to other users of the cluster by their permissions.
+	HotCacheSubject string         `json:"hot_cache_subject,omitempty"`
+	HotCacheTimeout caddy.Duration `json:"hot_cache_timeout,omitempty"`
+	// HotCacheSize is the number of values each instance serves
+	// (default 256).
+	HotCacheSize int `json:"hot_cache_size,omitempty"`
+
+	// ListFormat selects the form of the keys returned by List, either
+	// "certmagic" (the default) for slash separated keys or "nats" for
+	// the dotted form stored in the bucket.
+	ListFormat string `json:"list_format,omitempty"`
+
+	// InvalidKeys decides what List does with stored keys which don't
+	// denormalize to a well formed certmagic key, e.g. subjects added
+	// by hand: "skip" (the default) logs and leaves them out, "error"
+	// fails the List with ErrInvalidStoredKey and "keep" returns them.
+	InvalidKeys string `json:"invalid_keys,omitempty"`
+
+	// ListLimit caps the number of keys List gathers, guarding against
+	// listing a huge bucket by accident. Unlimited when zero.
+	ListLimit int `json:"list_limit,omitempty"`
+
+	// ListBatchSize makes List page through the bucket, fetching this
+	// many keys per request, instead of having all keys pushed at once,
+	// for buckets too large to list before a timeout.
+	ListBatchSize int `json:"list_batch_size,omitempty"`
+
+	// ValueSizeBuckets are the ascending upper bounds, in bytes, of the
+	// value size histogram in MetricsSnapshot, 1KiB up to 1MiB in
+	// factors of four by default. Larger values land in an extra bucket.
+	ValueSizeBuckets []int64 `json:"value_size_buckets,omitempty"`
+
+	// ListMissingIsError makes List return fs.ErrNotExist for a prefix
+	// without any keys below it, instead of an empty slice.
+	ListMissingIsError bool `json:"list_missing_is_error,omitempty"`
+
+	// ListCacheTTL caches List results for this long, e.g. for
+	// dashboards listing the same prefixes repeatedly. Stores and
+	// deletes through this instance invalidate the affected results,
+	// changes made elsewhere are seen once the results expire.
+	ListCacheTTL caddy.Duration `json:"list_cache_ttl,omitempty"`
+
+	// BreakerThreshold opens a circuit breaker after this many
+	// consecutive storage failures, failing operations fast for
+	// BreakerCooldown before probing NATS again. Disabled when zero.
+	BreakerThreshold int            `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  caddy.Duration `json:"breaker_cooldown,omitempty"`
+
+	// ReadOnlyAfter refuses writes with ErrReadOnly after this many
+	// consecutive write failures, e.g. while JetStream has lost quorum,
+	// still serving reads. Every ReadOnlyProbeInterval (default 10s)
+	// one write is let through, the first to succeed ends read only
+	// mode. Disabled when zero.
+	ReadOnlyAfter         int            `json:"read_only_after,omitempty"`
+	ReadOnlyProbeInterval caddy.Duration `json:"read_only_probe_interval,omitempty"`
+
+	// SlowOpThreshold logs a warning for every call to NATS taking
+	// longer than this. Disabled when zero.
+	SlowOpThreshold caddy.Duration `json:"slow_op_threshold,omitempty"`
+
+	// TracerProvider creates a span for every Store, Load, Delete and
+	// List. Without it spans are only created below a span already in
+	// the operation's context.
+	TracerProvider trace.TracerProvider `json:"-"`
+
+	// Fallback receives all certmagic operations while the connection
+	// to NATS is down, e.g. during bootstrap before NATS is reachable.
+	// FallbackRaw configures it as a caddy.storage module.
+	Fallback    certmagic.Storage `json:"-"`
+	FallbackRaw json.RawMessage   `json:"fallback,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// kvlock guards the kv and JetStream handles which are replaced
+	// after a reconnect
+	kvlock sync.RWMutex
+
+	breaker   *breaker
+	readOnly  *readOnly
+	listCache *listCache
+	memCache  *memCache
+	hotCache  *hotCache
+	webhooks  *webhooks
+
+	// tenants holds the instances serving buckets selected by
+	// BucketContextKey
+	tenantLock sync.Mutex
+	tenants    map[string]*Nats
+	caddyCtx   caddy.Context
+
+	compactStop chan struct{}
+	compactDone chan struct{}
+
+	// activeTarget indexes targets(), guarded by idleLock
+	activeTarget int
+	failoverStop chan struct{}
+	failoverDone chan struct{}
+
+	metrics metrics
+
+	// lastOp is the time the last operation ran, in unix nanoseconds
+	lastOp        atomic.Int64
+	heldLocks     atomic.Int64
+	keepaliveStop chan struct{}
+
+	// held is the registry of locks this instance acquired and didn't
+	// unlock yet
+	heldLock sync.Mutex
+	held     map[string]struct{}
+
+	// idleLock guards closing idle connections against operations
+	// reconnecting them
+	idleLock   sync.Mutex
+	idleClosed bool
+	idleStop   chan struct{}
+	activeOps  atomic.Int64
+
+	usingFallback atomic.Bool
+
+	pending     []nats.PubAckFuture
+	pendingLock sync.Mutex
+
 	revMap  map[string]uint64
 	maplock sync.Mutex
 }
 
+var (
+	// ErrPayloadTooLarge is returned by Store when a value exceeds the
+	// maximum payload accepted by the NATS server.
+	ErrPayloadTooLarge = errors.New("value exceeds nats max payload")
+
+	// ErrInvalidPEM is returned by Store with ValidatePEM when a
+	// certificate or key isn't PEM encoded.
+	ErrInvalidPEM = errors.New("value is not pem encoded")
+
+	// ErrKeyTooLong is returned by Store when the normalized key
+	// exceeds the length or token count NATS subjects can carry.
+	ErrKeyTooLong = errors.New("key too long for nats subject")
+
+	// ErrRevisionMismatch is returned by CompareAndSwap when the key
+	// was modified since the expected revision.
+	ErrRevisionMismatch = errors.New("revision mismatch")
+
+	// ErrListTruncated is returned by List along with the keys
+	// gathered so far when more than ListLimit keys match.
+	ErrListTruncated = errors.New("list truncated")
+
+	// ErrJetStreamNotEnabled is returned by Provision when the account
+	// used to connect has no access to JetStream.
+	ErrJetStreamNotEnabled = errors.New("jetstream is not enabled for the nats account")
+
+	// ErrAccountStorage is returned by Provision with
+	// RequireAccountStorage when the account has less JetStream storage
+	// left than MinAccountStorage.
+	ErrAccountStorage = errors.New("jetstream account storage too low")
+
+	// ErrChecksumMismatch is returned by Load when a value doesn't
+	// match the checksum stored with it.
+	ErrChecksumMismatch = errors.New("value checksum mismatch")
+
+	// ErrBucketDrift is returned by VerifyBucketConfig when the live
+	// bucket doesn't match BucketConfig.
+	ErrBucketDrift = errors.New("bucket config drifted")
+
+	// ErrDraining is returned by operations started while the
+	// connection drains during Cleanup.
+	ErrDraining = errors.New("nats connection draining")
+
+	// ErrPermission is returned along with the NATS error when the
+	// account isn't allowed to access a subject. Retrying won't help,
+	// so it doesn't count against the breaker.
+	ErrPermission = errors.New("permission denied")
+
+	// ErrTooManyLocks is returned by Lock while the instance holds
+	// MaxHeldLocks locks.
+	ErrTooManyLocks = errors.New("too many locks held")
+
+	// ErrInvalidStoredKey is returned by List with InvalidKeys "error"
+	// when a key in the bucket isn't a well formed certmagic key.
+	ErrInvalidStoredKey = errors.New("invalid stored key")
+)
+
 var (
 	_ caddy.Provisioner = (*Nats)(nil)
 	_ certmagic.Storage = (*Nats)(nil)
 	_ certmagic.Locker  = (*Nats)(nil)
 )
 
+const (
+	// ListFormatCertmagic lists keys the way certmagic named them.
+	ListFormatCertmagic = "certmagic"
+	// ListFormatNats lists keys the way they are stored in the bucket.
+	ListFormatNats = "nats"
+)
+
+const (
+	// InvalidKeysSkip leaves malformed stored keys out of List.
+	InvalidKeysSkip = "skip"
+	// InvalidKeysError fails List on malformed stored keys.
+	InvalidKeysError = "error"
+	// InvalidKeysKeep returns malformed stored keys as they are.
+	InvalidKeysKeep = "keep"
+)
+
+// wellFormedKey reports whether key is a certmagic key: slash
+// separated segments which are neither empty nor "." or "..", without
+// control characters.
+func wellFormedKey(key string) bool {
+	if key == "" || !utf8.ValidString(key) {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return strings.IndexFunc(key, unicode.IsControl) < 0
+}
+
 // should be save to use as it is not allowed to be used in urls
 const replaceChar = "#"
 
@@ -59,23 +634,301 @@ func denormalizeNatsKey(key string) string {
 	return key
 }
 
-func connectNats(host, creds, bucket, connectionName, inboxPrefix string) (nats.KeyValue, error) {
-	options := []nats.Option{nats.Name(connectionName), nats.CustomInboxPrefix(inboxPrefix)}
-	if creds != "" {
+const (
+	// hashedKeyPrefix holds all keys that got hashed because of their length
+	hashedKeyPrefix = "HASH."
+	// keyHeader carries the original certmagic key of hashed keys
+	keyHeader = "Caddy-Key"
+)
+
+// normalize converts a certmagic key to a nats key, applying KeyEncode
+// first. Unless RawKeys is set slashes become dots.
+func (n *Nats) normalize(key string) string {
+	if n.KeyEncode != nil {
+		key = n.KeyEncode(key)
+	}
+	if n.RawKeys {
+		return key
+	}
+	return normalizeNatsKey(key)
+}
+
+// denormalize reverses normalize.
+func (n *Nats) denormalize(nkey string) string {
+	if !n.RawKeys {
+		nkey = denormalizeNatsKey(nkey)
+	}
+	if n.KeyDecode != nil {
+		nkey = n.KeyDecode(nkey)
+	}
+	return nkey
+}
+
+// validRawKey matches the keys a bucket accepts.
+var validRawKey = regexp.MustCompile(`^[-/_=.a-zA-Z0-9]+$`)
+
+var validLockNamespace = regexp.MustCompile(`^[-_=a-zA-Z0-9]+$`)
+
+// natsKey maps a certmagic key to the key used in the bucket.
+func (n *Nats) natsKey(key string) string {
+	key = n.prefixed(n.canonicalKey(key))
+	nkey := n.normalize(n.obfuscate(key))
+	if n.HashKeysLongerThan > 0 && len(nkey) > n.HashKeysLongerThan {
+		sum := sha256.Sum256([]byte(key))
+		return hashedKeyPrefix + hex.EncodeToString(sum[:])
+	}
+	return nkey
+}
+
+// prefixed places the canonical key or prefix below KeyPrefix.
+func (n *Nats) prefixed(key string) string {
+	switch {
+	case n.KeyPrefix == "":
+		return key
+	case key == "":
+		return n.KeyPrefix
+	}
+	return n.KeyPrefix + "/" + key
+}
+
+// stripPrefix reverses prefixed, ok is false for keys outside of
+// KeyPrefix. The prefix only matches whole segments, with KeyPrefix
+// "certs" neither "certs" itself nor "certs2/a" are below it.
+func (n *Nats) stripPrefix(key string) (string, bool) {
+	if n.KeyPrefix == "" {
+		return key, true
+	}
+	rest, ok := strings.CutPrefix(key, n.KeyPrefix+"/")
+	return rest, ok && rest != ""
+}
+
+// canonicalKey applies the configured case normalization to key.
+func (n *Nats) canonicalKey(key string) string {
+	if !n.LowercaseKeys {
+		return key
+	}
+
+	// only domain names are case insensitive, leave other parts as is
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		if isAccountPath(parts[:i]) {
+			// ACME accounts are named by the email address, whose
+			// local part is case sensitive
+			break
+		}
+		if isDomainLike(parts[i]) {
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// isAccountPath reports whether the key segments parts lead to the
+// ACME accounts certmagic stores as acme/<issuer>/users/<email>.
+func isAccountPath(parts []string) bool {
+	return len(parts) >= 3 && parts[0] == "acme" && parts[2] == "users"
+}
+
+// isDomainLike reports whether a key segment looks like a domain name,
+// possibly followed by a file extension such as example.com.crt.
+func isDomainLike(segment string) bool {
+	if !strings.Contains(segment, ".") {
+		return false
+	}
+
+	for _, r := range segment {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '-', r == '_', r == '*':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// PreviewNormalize returns the bucket key each of keys would be stored
+// under, without touching the store. Two keys mapping to the same
+// value would overwrite each other.
+func (n *Nats) PreviewNormalize(keys []string) map[string]string {
+	preview := make(map[string]string, len(keys))
+	for _, key := range keys {
+		preview[key] = n.natsKey(key)
+	}
+	return preview
+}
+
+func isHashedKey(nkey string) bool {
+	return strings.HasPrefix(nkey, hashedKeyPrefix)
+}
+
+// natsOptions returns the options used to connect to the server
+// authenticating with creds.
+func (n *Nats) natsOptions(creds string) []nats.Option {
+	options := []nats.Option{nats.Name(n.connectionName()), nats.CustomInboxPrefix(n.InboxPrefix)}
+	if n.JWTProvider != nil {
+		options = append(options, nats.UserJWT(n.JWTProvider, n.jwtSigner(creds)))
+	} else if creds != "" {
 		options = append(options, nats.UserCredentials(creds))
 	}
+	if n.CertFile != "" {
+		options = append(options, nats.Secure(n.tlsConfig()))
+	}
+	if n.CAFile != "" {
+		options = append(options, nats.RootCAs(n.CAFile))
+	}
+	if n.TLSFirst {
+		options = append(options, nats.TLSHandshakeFirst())
+	}
+	if n.WireCompression {
+		options = append(options, nats.Compression(true))
+	}
+	if n.WebsocketPath != "" {
+		options = append(options, nats.ProxyPath(n.WebsocketPath))
+	}
+
+	if n.ReconnectBufSize != 0 {
+		options = append(options, nats.ReconnectBufSize(n.ReconnectBufSize))
+	}
+	if n.PingInterval > 0 {
+		options = append(options, nats.PingInterval(time.Duration(n.PingInterval)))
+	}
+
+	jitter, jitterTLS := time.Duration(n.ReconnectJitter), time.Duration(n.ReconnectJitterTLS)
+	if jitter == 0 {
+		jitter = nats.DefaultReconnectJitter
+	}
+	if jitterTLS == 0 {
+		jitterTLS = nats.DefaultReconnectJitterTLS
+	}
+	options = append(options, nats.ReconnectJitter(jitter, jitterTLS))
+	return options
+}
+
+// connect dials host and binds bucket, storing the handles as the read
+// or write connection. With a fallback storage an unreachable server
+// is not an error, the bucket is bound once the server comes up.
+func (n *Nats) connect(host, creds, bucket string, read bool) (*nats.Conn, error) {
+	options := n.natsOptions(creds)
+	options = append(options, nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+		n.notifyConn("disconnect", redactHosts(host), err)
+	}))
+	lazy := n.Fallback != nil && !read
+	if lazy {
+		options = append(options,
+			nats.RetryOnFailedConnect(true),
+			nats.MaxReconnects(-1),
+			nats.ConnectHandler(func(nc *nats.Conn) {
+				n.rebind(nc, bucket, read)
+				n.notifyConn("connect", nc.ConnectedUrlRedacted(), nil)
+			}),
+		)
+	}
 
+	hosts := redactHosts(host)
 	nc, err := nats.Connect(host, options...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("nats: connect to [%v] failed: %w", hosts, err)
+	}
+
+	nc.SetReconnectHandler(func(nc *nats.Conn) {
+		n.rebind(nc, bucket, read)
+		n.notifyConn("reconnect", nc.ConnectedUrlRedacted(), nil)
+	})
+	if lazy && !nc.IsConnected() {
+		n.logger.Warn(fmt.Sprintf("NATS at %v is unavailable, using fallback storage until connected", host))
+		return nc, nil
+	}
+
+	js, kv, err := bindBucket(nc, bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) && n.BucketConfig != nil && !read {
+		js, kv, err = n.createBucket(nc)
+	}
+	if err != nil {
+		nc.Close()
+		// without JetStream nobody answers the API request for the bucket
+		if errors.Is(err, nats.ErrNoResponders) || errors.Is(err, nats.ErrJetStreamNotEnabled) || errors.Is(err, nats.ErrJetStreamNotEnabledForAccount) {
+			return nil, fmt.Errorf("nats: jetstream at [%v] failed: %w: enable JetStream on the server and grant it to the account connecting", hosts, ErrJetStreamNotEnabled)
+		}
+		return nil, fmt.Errorf("nats: bind bucket %v at [%v] failed: %w", bucket, hosts, err)
+	}
+
+	// bind the mirror first, a failing failover target must not replace
+	// the handles of the active one
+	if !read {
+		if err := n.bindMirror(js); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("nats: bind at [%v] failed: %w", hosts, err)
+		}
 	}
+	n.setHandles(js, kv, read)
+	n.notifyConn("connect", nc.ConnectedUrlRedacted(), nil)
+	return nc, nil
+}
 
+func bindBucket(nc *nats.Conn, bucket string) (nats.JetStreamContext, nats.KeyValue, error) {
 	js, err := nc.JetStream(nats.PublishAsyncMaxPending(256))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	kv, err := js.KeyValue(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return js, kv, nil
+}
+
+// rebind refreshes the kv handles once nc (re)connects, so operations
+// keep working against the new server connection.
+func (n *Nats) rebind(nc *nats.Conn, bucket string, read bool) {
+	js, kv, err := bindBucket(nc, bucket)
+	if err != nil {
+		n.logger.Error(fmt.Sprintf("Bind bucket %v after connect: %v", bucket, err))
+		return
+	}
+
+	n.setHandles(js, kv, read)
+	if !read {
+		if err := n.bindMirror(js); err != nil {
+			n.logger.Error(fmt.Sprintf("Bind after connect: %v", err))
+		}
+		if err := n.hotCache.bind(nc); err != nil {
+			n.logger.Error(fmt.Sprintf("Bind after connect: %v", err))
+		}
 	}
+	if r, _ := n.reader(); r == kv {
+		if err := n.memCache.watch(kv); err != nil {
+			n.logger.Error(fmt.Sprintf("Bind after connect: %v", err))
+		}
+	}
+	n.logger.Info(fmt.Sprintf("Bound bucket %v after connect to %v", bucket, nc.ConnectedUrlRedacted()))
+}
+
+func (n *Nats) setHandles(js nats.JetStreamContext, kv nats.KeyValue, read bool) {
+	n.kvlock.Lock()
+	defer n.kvlock.Unlock()
+	if read {
+		n.readJS, n.readClient = js, kv
+	} else {
+		n.js, n.Client = js, kv
+	}
+}
+
+// conns returns the write and read connections, the latter nil when
+// reads share the write connection.
+func (n *Nats) conns() (*nats.Conn, *nats.Conn) {
+	n.kvlock.RLock()
+	defer n.kvlock.RUnlock()
+	return n.conn, n.readConn
+}
 
-	return js.KeyValue(bucket)
+// writer returns the bucket and JetStream context used for writes.
+func (n *Nats) writer() (nats.KeyValue, nats.JetStreamContext) {
+	n.kvlock.RLock()
+	defer n.kvlock.RUnlock()
+	return n.Client, n.js
 }
 
 func (n *Nats) setRev(key string, value uint64) {
@@ -90,6 +943,83 @@ func (n *Nats) getRev(key string) uint64 {
 	return n.revMap[key]
 }
 
+// run executes a single call against NATS on behalf of the operation
+// op, applying the circuit breaker and logging calls slower than
+// SlowOpThreshold.
+func (n *Nats) run(op, key string, fn func() error) error {
+	done, err := n.wake()
+	if err != nil {
+		return fmt.Errorf("%s %v: %w", op, key, err)
+	}
+	defer done()
+
+	if err := n.connErr(); err != nil {
+		return fmt.Errorf("%s %v: %w", op, key, err)
+	}
+
+	if err := n.breaker.allow(); err != nil {
+		return fmt.Errorf("%s %v: %w", op, key, err)
+	}
+
+	if kv, _ := n.reader(); kv == nil {
+		return fmt.Errorf("%s %v: %w", op, key, ErrNotConnected)
+	}
+
+	start := time.Now()
+	n.lastOp.Store(start.UnixNano())
+	err = fn()
+	if isPermissionDenied(err) {
+		n.logger.Error(fmt.Sprintf("Permission denied for %s %v: %v", op, key, err))
+		err = fmt.Errorf("%w: %w", ErrPermission, err)
+	}
+	elapsed := time.Since(start)
+	n.metrics.record(op, elapsed, err)
+	if isFailure(err) {
+		n.notifyConn("jetstream_error", "", fmt.Errorf("%s %v: %w", op, key, err))
+	}
+	if threshold := time.Duration(n.SlowOpThreshold); threshold > 0 && elapsed > threshold {
+		n.logger.Warn(fmt.Sprintf("Slow %s: %v took %v", op, key, elapsed))
+	}
+	n.breaker.record(err)
+	return err
+}
+
+// connErr fails operations on connections which are draining or
+// closed, instead of letting them error deep inside nats.go.
+func (n *Nats) connErr() error {
+	conn, readConn := n.conns()
+	for _, nc := range []*nats.Conn{conn, readConn} {
+		switch {
+		case nc == nil:
+		case nc.IsDraining():
+			return ErrDraining
+		case nc.IsClosed():
+			return nats.ErrConnectionClosed
+		}
+	}
+	return nil
+}
+
+// isKeyNotFound reports whether err means the key has no value,
+// either because it never existed or because it was deleted or purged.
+func isKeyNotFound(err error) bool {
+	return errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrKeyDeleted)
+}
+
+// isPermissionDenied reports whether err is a permissions or
+// authorization violation reported by the server. The message names
+// the subject which was denied.
+func isPermissionDenied(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, nats.ErrAuthorization) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "permissions violation") || strings.Contains(msg, "authorization violation")
+}
+
 func isWrongSequence(err error) bool {
 	return strings.Contains(err.Error(), "wrong last sequence")
 }
@@ -112,14 +1042,48 @@ func isWrongSequence(err error) bool {
 // case Unlock is unable to be called due to some sort of network
 // failure or system crash.
 func (n *Nats) Lock(ctx context.Context, key string) error {
+	if t, err := n.tenant(ctx); err != nil {
+		return err
+	} else if t != nil {
+		return t.Lock(ctx, key)
+	}
 	n.logger.Info(fmt.Sprintf("Lock: %v", key))
-	lockKey := fmt.Sprintf("LOCK.%s", key)
+	if fb := n.fallback(); fb != nil {
+		return fb.Lock(ctx, key)
+	}
+
+	if err := n.reserveLock(key); err != nil {
+		return err
+	}
+	err := n.lock(ctx, key)
+	if err != nil {
+		n.heldLocks.Add(-1)
+		return err
+	}
+
+	n.heldLock.Lock()
+	defer n.heldLock.Unlock()
+	if n.held == nil {
+		n.held = make(map[string]struct{})
+	}
+	n.held[key] = struct{}{}
+	return nil
+}
+
+func (n *Nats) lock(ctx context.Context, key string) error {
+	lockKey := n.lockKey(key)
+	var waiting bool
 
 loop:
 	for {
 		// Check for existing lock
-		revision, err := n.Client.Get(lockKey)
-		if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		var revision nats.KeyValueEntry
+		err := n.run("Lock", key, func() (err error) {
+			kv, _ := n.writer()
+			revision, err = kv.Get(lockKey)
+			return err
+		})
+		if err != nil && !isKeyNotFound(err) {
 			return err
 		}
 
@@ -127,13 +1091,14 @@ loop:
 			break
 		}
 
-		expires := time.Unix(0, int64(binary.LittleEndian.Uint64(revision.Value())))
+		// a malformed lock counts as expired
+		expires, holder, _ := parseLock(revision.Value())
 		// Lock exists, check if expired
-		if time.Now().After(expires) {
+		if time.Now().After(expires.Add(time.Duration(n.LockStaleGrace))) {
 			// the lock expired and can be deleted
 			// break and try to create a new one
 			n.setRev(lockKey, revision.Revision())
-			if err := n.Unlock(ctx, key); err != nil {
+			if err := n.unlock(key); err != nil {
 				if isWrongSequence(err) {
 					goto loop
 				}
@@ -142,6 +1107,11 @@ loop:
 			break
 		}
 
+		if !waiting && holder != "" {
+			n.logger.Info(fmt.Sprintf("Lock: %v is held by %v, waiting", key, holder))
+			waiting = true
+		}
+
 		select {
 		// retry after a short period of time
 		case <-time.After(time.Duration(50+rand.Float64()*(200-50+1)) * time.Millisecond):
@@ -151,10 +1121,13 @@ loop:
 	}
 
 	// lock doesn't exist, create it
-	contents := make([]byte, 8)
-	binary.LittleEndian.PutUint64(contents, uint64(time.Now().Add(time.Duration(5*time.Minute)).UnixNano()))
-	nrev, err := n.Client.Create(lockKey, contents)
-	if err != nil && isWrongSequence(err) {
+	contents := lockValue(time.Now().Add(lockTTL), n.Identity)
+	var nrev uint64
+	err := n.runWrite("Lock", key, func() (err error) {
+		nrev, err = n.createLock(lockKey, contents)
+		return err
+	})
+	if err != nil && (isWrongSequence(err) || errors.Is(err, nats.ErrKeyExists)) {
 		// another process created the lock in the meantime
 		// try again
 		goto loop
@@ -173,107 +1146,1210 @@ loop:
 // critical section is finished, even if it errored or timed
 // out. Unlock cleans up any resources allocated during Lock.
 func (n *Nats) Unlock(ctx context.Context, key string) error {
+	if t, err := n.tenant(ctx); err != nil {
+		return err
+	} else if t != nil {
+		return t.Unlock(ctx, key)
+	}
 	n.logger.Info(fmt.Sprintf("Unlock: %v", key))
-	lockKey := fmt.Sprintf("LOCK.%s", key)
-	return n.Client.Delete(lockKey, nats.LastRevision(n.getRev(lockKey)))
+	if fb := n.fallback(); fb != nil {
+		return fb.Unlock(ctx, key)
+	}
+
+	// the lock is gone even if deleting it failed, e.g. because it
+	// expired and was taken over. Only locks this instance holds count
+	// against MaxHeldLocks.
+	n.heldLock.Lock()
+	_, held := n.held[key]
+	delete(n.held, key)
+	n.heldLock.Unlock()
+	if held {
+		defer n.releaseLock()
+	}
+	return n.unlock(key)
 }
 
-func (n *Nats) Store(ctx context.Context, key string, value []byte) error {
-	n.logger.Info(fmt.Sprintf("Store: %v, %v bytes", key, len(value)))
-	_, err := n.Client.Put(normalizeNatsKey(key), value)
-	return err
+func (n *Nats) unlock(key string) error {
+	lockKey := n.lockKey(key)
+	return n.runWrite("Unlock", key, func() error {
+		kv, _ := n.writer()
+		return kv.Delete(lockKey, nats.LastRevision(n.getRev(lockKey)))
+	})
 }
 
-func (n *Nats) Load(ctx context.Context, key string) ([]byte, error) {
-	n.logger.Info(fmt.Sprintf("Load: %v", key))
-	k, err := n.Client.Get(normalizeNatsKey(key))
-	if err != nil {
-		if err == nats.ErrKeyNotFound {
-			return nil, fs.ErrNotExist
+// IsLocked reports whether any instance currently holds the lock for
+// key, without acquiring it. Locks past their expiry and LockStaleGrace
+// count as released.
+func (n *Nats) IsLocked(ctx context.Context, key string) (bool, error) {
+	n.logger.Info(fmt.Sprintf("IsLocked: %v", key))
+
+	var entry nats.KeyValueEntry
+	err := n.run("IsLocked", key, func() (err error) {
+		kv, _ := n.writer()
+		entry, err = kv.Get(n.lockKey(key))
+		return err
+	})
+	if isKeyNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	expires, _, ok := parseLock(entry.Value())
+	return ok && time.Now().Before(expires.Add(time.Duration(n.LockStaleGrace))), nil
+}
+
+// releaseHeldLocks unlocks every lock this instance still holds.
+func (n *Nats) releaseHeldLocks(ctx context.Context) {
+	n.heldLock.Lock()
+	keys := make([]string, 0, len(n.held))
+	for key := range n.held {
+		keys = append(keys, key)
+	}
+	n.heldLock.Unlock()
+
+	for _, key := range keys {
+		if err := n.Unlock(ctx, key); err != nil {
+			n.logger.Warn(fmt.Sprintf("Releasing lock %v on cleanup: %v", key, err))
+		}
+	}
+	if len(keys) > 0 {
+		n.logger.Info(fmt.Sprintf("Released %d locks on cleanup", len(keys)))
+	}
+}
+
+// defaultMaxHeldLocks is the number of locks an instance may hold at
+// once when MaxHeldLocks isn't set.
+const defaultMaxHeldLocks = 1024
+
+// reserveLock counts a lock about to be acquired against MaxHeldLocks.
+func (n *Nats) reserveLock(key string) error {
+	limit := int64(n.MaxHeldLocks)
+	if limit <= 0 {
+		limit = defaultMaxHeldLocks
+	}
+
+	for {
+		held := n.heldLocks.Load()
+		if held >= limit {
+			return fmt.Errorf("lock %v: %w: holding %d locks", key, ErrTooManyLocks, held)
+		}
+		if n.heldLocks.CompareAndSwap(held, held+1) {
+			return nil
+		}
+	}
+}
+
+// releaseLock stops counting a lock released by Unlock.
+func (n *Nats) releaseLock() {
+	for {
+		held := n.heldLocks.Load()
+		if held <= 0 || n.heldLocks.CompareAndSwap(held, held-1) {
+			return
+		}
+	}
+}
+
+// lockKey returns the nats key holding the lock for key.
+func (n *Nats) lockKey(key string) string {
+	return n.lockPrefix() + n.obfuscate(n.canonicalKey(key))
+}
+
+// lockPrefix returns the prefix of the nats keys of locks in
+// LockNamespace.
+func (n *Nats) lockPrefix() string {
+	if n.LockNamespace == "" {
+		return "LOCK."
+	}
+	return "LOCK." + n.LockNamespace + "."
+}
+
+// CountLocks returns the number of locks currently held by any
+// instance in LockNamespace. Without a namespace it counts the locks of
+// all namespaces, their keys can't be told apart from lock names with
+// dots. Released locks and locks past their expiry and LockStaleGrace
+// are not counted.
+func (n *Nats) CountLocks(ctx context.Context) (int, error) {
+	n.logger.Info("CountLocks")
+
+	var count int
+	err := n.run("CountLocks", "LOCK", func() error {
+		kv, _ := n.writer()
+		watcher, err := kv.Watch(n.lockPrefix()+">", nats.IgnoreDeletes(), nats.Context(ctx))
+		if err != nil {
+			return err
+		}
+		defer watcher.Stop()
+
+		now := time.Now()
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				break
+			}
+			expires, _, ok := parseLock(entry.Value())
+			if ok && now.Before(expires.Add(time.Duration(n.LockStaleGrace))) {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (n *Nats) Store(ctx context.Context, key string, value []byte) error {
+	if t, err := n.tenant(ctx); err != nil {
+		return err
+	} else if t != nil {
+		return t.Store(ctx, key, value)
+	}
+	span := n.startSpan(ctx, "Store", key)
+	var err error
+	if fb := n.fallback(); fb != nil {
+		n.logger.Info(fmt.Sprintf("Store: %v, %v bytes", key, len(value)))
+		err = fb.Store(ctx, key, value)
+	} else {
+		_, err = n.StoreR(ctx, key, value)
+	}
+	endSpan(span, len(value), err)
+	return err
+}
+
+// StoreR behaves like Store but also returns the KV revision of the
+// written value.
+func (n *Nats) StoreR(ctx context.Context, key string, value []byte) (uint64, error) {
+	n.logger.Info(fmt.Sprintf("Store: %v, %v bytes", key, len(value)))
+	raw := value
+	if err := n.checkPEM(key, value); err != nil {
+		return 0, err
+	}
+	value, hdr := n.encodeValue(value)
+	if err := n.checkWrite(key, value); err != nil {
+		return 0, err
+	}
+	if n.DedupWindow > 0 && !n.CASWrites && !n.AsyncWrites {
+		hdr = n.dedupHeader(key, value, hdr)
+	}
+
+	var rev uint64
+	err := n.runWrite("Store", key, func() error {
+		return retryWrite(ctx, func() (err error) {
+			if n.CASWrites {
+				rev, err = n.storeCAS(key, value, hdr)
+				return err
+			}
+			rev, err = n.put(key, value, 0, hdr)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	n.metrics.valueSize(len(raw))
+	n.hotCache.put(n.natsKey(key), raw)
+
+	return rev, n.mirror("Store", key, func(kv nats.KeyValue, js nats.JetStreamContext) error {
+		_, err := n.putTo(kv, js, key, value, 0, hdr)
+		return err
+	})
+}
+
+// retryFor bounds retrying an operation.
+const retryFor = 5 * time.Second
+
+// retryable reports whether an operation failing with err may run
+// again. Reads don't change the bucket and are retried on any transient
+// error. Writes are only retried on no responders, which happens
+// briefly while the JetStream cluster elects a new leader and means the
+// request reached no server. After a timeout the write may have been
+// applied without its ack arriving, running it again could apply it
+// twice.
+func retryable(err error, read bool) bool {
+	if errors.Is(err, nats.ErrNoResponders) {
+		return true
+	}
+	return read && (errors.Is(err, nats.ErrTimeout) || errors.Is(err, nats.ErrConnectionReconnecting))
+}
+
+// retryRead retries fn, which must not change the bucket, up to
+// ReadRetries times while it fails with a transient error.
+func (n *Nats) retryRead(ctx context.Context, fn func() error) error {
+	return retry(ctx, true, n.ReadRetries, fn)
+}
+
+// retryWrite retries fn while it fails before reaching a server.
+func retryWrite(ctx context.Context, fn func() error) error {
+	return retry(ctx, false, -1, fn)
+}
+
+// retry retries fn with a growing backoff while its error is
+// retryable, at most retries times unless negative. Other errors are
+// returned immediately.
+func retry(ctx context.Context, read bool, retries int, fn func() error) error {
+	wait := 50 * time.Millisecond
+	deadline := time.Now().Add(retryFor)
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !retryable(err, read) || (retries >= 0 && attempt >= retries) || time.Now().Add(wait).After(deadline) {
+			return err
 		}
 
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// CompareAndSwap stores value at key only if the latest revision of
+// key is expectedRevision, returning the revision of the new value.
+// ErrRevisionMismatch is returned if the key was modified in the
+// meantime.
+func (n *Nats) CompareAndSwap(ctx context.Context, key string, expectedRevision uint64, value []byte) (uint64, error) {
+	n.logger.Info(fmt.Sprintf("CompareAndSwap: %v, revision %v, %v bytes", key, expectedRevision, len(value)))
+	raw := value
+	if err := n.checkPEM(key, value); err != nil {
+		return 0, err
+	}
+	value, hdr := n.encodeValue(value)
+	if err := n.checkWrite(key, value); err != nil {
+		return 0, err
+	}
+
+	var rev uint64
+	err := n.runWrite("CompareAndSwap", key, func() (err error) {
+		rev, err = n.put(key, value, expectedRevision, hdr)
+		return err
+	})
+	if err != nil {
+		if isWrongSequence(err) {
+			return 0, fmt.Errorf("compare and swap %v: %w", key, ErrRevisionMismatch)
+		}
+		return 0, err
+	}
+
+	n.metrics.valueSize(len(raw))
+	n.hotCache.put(n.natsKey(key), raw)
+
+	// revisions differ between the buckets, the mirror takes the value
+	// unconditionally
+	return rev, n.mirror("CompareAndSwap", key, func(kv nats.KeyValue, js nats.JetStreamContext) error {
+		_, err := n.putTo(kv, js, key, value, 0, hdr)
+		return err
+	})
+}
+
+// put writes value to key along with the headers in hdr. If last is
+// not zero the write is rejected unless last is the latest revision of
+// key.
+func (n *Nats) put(key string, value []byte, last uint64, hdr nats.Header) (uint64, error) {
+	kv, js := n.writer()
+	n.listCache.invalidate(n.canonicalKey(key))
+	n.memCache.invalidate(n.natsKey(key))
+	n.hotCache.invalidate(n.natsKey(key))
+	return n.putTo(kv, js, key, value, last, hdr)
+}
+
+// putTo is put against the given bucket.
+func (n *Nats) putTo(kv nats.KeyValue, js nats.JetStreamContext, key string, value []byte, last uint64, hdr nats.Header) (uint64, error) {
+	nkey := n.natsKey(key)
+	async := n.AsyncWrites && last == 0
+	// hashed and obfuscated keys lose their name, keep the original one
+	// as a header
+	named := isHashedKey(nkey) || (n.ObfuscateKeysSecret != "" && isObfuscated(nkey))
+	store := storeOf(kv, js)
+	if !named && len(hdr) == 0 && !async {
+		if last != 0 {
+			return store.Update(nkey, value, last)
+		}
+		return store.Put(nkey, value)
+	}
+
+	// the kv api has no headers or async writes, publish to the bucket
+	// subject directly
+	msg := nats.NewMsg(kvSubject(kv, nkey))
+	for k, v := range hdr {
+		msg.Header[k] = v
+	}
+	if named {
+		msg.Header.Set(keyHeader, n.prefixed(n.canonicalKey(key)))
+	}
+	msg.Data = value
+
+	if async {
+		return 0, n.publishAsync(js, msg)
+	}
+
+	var opts []nats.PubOpt
+	if last != 0 {
+		opts = append(opts, nats.ExpectLastSequencePerSubject(last))
+	}
+
+	ack, err := store.PublishMsg(msg, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if ack.Duplicate {
+		return republishDuplicate(store, nkey, msg, ack)
+	}
+	return ack.Sequence, nil
+}
+
+// republishDuplicate handles msg dropped by the server as a repeat of
+// the write acknowledged by ack with the same message id. That write is
+// still current if it's the last one on the subject. Otherwise the key
+// changed since, e.g. A, B and A again within the window, and msg is
+// published again without the id so the latest Store wins.
+func republishDuplicate(store kvStore, nkey string, msg *nats.Msg, ack *nats.PubAck) (uint64, error) {
+	last, err := store.GetLastMsg(nkey)
+	if err == nil && last.Sequence == ack.Sequence {
+		return ack.Sequence, nil
+	}
+	if err != nil && !errors.Is(err, nats.ErrMsgNotFound) {
+		return 0, err
+	}
+
+	again := nats.NewMsg(msg.Subject)
+	for k, v := range msg.Header {
+		if k != nats.MsgIdHdr {
+			again.Header[k] = v
+		}
+	}
+	again.Data = msg.Data
+	ack, err = store.PublishMsg(again)
+	if err != nil {
+		return 0, err
+	}
+	return ack.Sequence, nil
+}
+
+// kvStore is the part of a bucket the operations depend on: the kv api
+// and, for the headers it doesn't expose, the messages backing the
+// keys. natsStore implements it for a bucket bound on the server, a
+// Client implementing it itself, e.g. a fake in tests, is used as is.
+type kvStore interface {
+	Get(nkey string) (nats.KeyValueEntry, error)
+	Put(nkey string, value []byte) (uint64, error)
+	Create(nkey string, value []byte) (uint64, error)
+	Update(nkey string, value []byte, last uint64) (uint64, error)
+	Delete(nkey string, opts ...nats.DeleteOpt) error
+	Keys(opts ...nats.WatchOpt) ([]string, error)
+	Status() (nats.KeyValueStatus, error)
+
+	// GetLastMsg returns the latest message of nkey, delete markers
+	// included, or nats.ErrMsgNotFound.
+	GetLastMsg(nkey string) (*nats.RawStreamMsg, error)
+	// LastMsgs returns the headers of the latest message of every key
+	// matching the key filter, keyed by the nats key. The data is left
+	// out, its size is in the nats.MsgSize header.
+	LastMsgs(ctx context.Context, filter string) (map[string]*nats.RawStreamMsg, error)
+	// PublishMsg writes msg, addressed to kvSubject of a key.
+	PublishMsg(msg *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error)
+	// History returns the revisions of nkey kept by the bucket, oldest
+	// first.
+	History(nkey string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error)
+	// GetMsg returns the message stored at revision seq.
+	GetMsg(seq uint64) (*nats.RawStreamMsg, error)
+}
+
+// natsStore is the kvStore of a bucket on the server.
+type natsStore struct {
+	nats.KeyValue
+	js nats.JetStreamContext
+}
+
+func (s natsStore) GetLastMsg(nkey string) (*nats.RawStreamMsg, error) {
+	return s.js.GetLastMsg(kvStream(s), kvSubject(s, nkey))
+}
+
+func (s natsStore) LastMsgs(ctx context.Context, filter string) (map[string]*nats.RawStreamMsg, error) {
+	return lastMsgs(ctx, s.KeyValue, s.js, filter)
+}
+
+func (s natsStore) PublishMsg(msg *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	return s.js.PublishMsg(msg, opts...)
+}
+
+func (s natsStore) GetMsg(seq uint64) (*nats.RawStreamMsg, error) {
+	return s.js.GetMsg(kvStream(s), seq)
+}
+
+// storeOf returns the kvStore of kv bound with js.
+func storeOf(kv nats.KeyValue, js nats.JetStreamContext) kvStore {
+	if s, ok := kv.(kvStore); ok {
+		return s
+	}
+	return natsStore{KeyValue: kv, js: js}
+}
+
+// kvSubject returns the subject kv stores nkey under.
+func kvSubject(kv nats.KeyValue, nkey string) string {
+	return fmt.Sprintf("$KV.%s.%s", kv.Bucket(), nkey)
+}
+
+// kvStream returns the name of the stream backing kv.
+func kvStream(kv nats.KeyValue) string {
+	return "KV_" + kv.Bucket()
+}
+
+// reader returns the bucket and JetStream context used for reads.
+func (n *Nats) reader() (nats.KeyValue, nats.JetStreamContext) {
+	n.kvlock.RLock()
+	defer n.kvlock.RUnlock()
+	if n.readClient != nil {
+		return n.readClient, n.readJS
+	}
+	return n.Client, n.js
+}
+
+// originalKey reads the certmagic key stored alongside a hashed key.
+func (n *Nats) originalKey(nkey string) (string, error) {
+	msg, err := n.lastMsg(nkey)
+	if err != nil {
+		return "", err
+	}
+	return msg.Header.Get(keyHeader), nil
+}
+
+// Limits for keys after normalization. The server rejects protocol
+// lines longer than its max_control_line, 4096 bytes by default, which
+// must also fit the bucket prefix and headers.
+const (
+	maxKeyLength = 3072
+	maxKeyTokens = 256
+)
+
+// checkWrite validates key and the encoded value before writing them.
+func (n *Nats) checkWrite(key string, value []byte) error {
+	nkey := n.natsKey(key)
+	if n.RawKeys && !isHashedKey(nkey) && (!validRawKey.MatchString(nkey) || strings.HasPrefix(nkey, ".") || strings.HasSuffix(nkey, ".")) {
+		return fmt.Errorf("store %v: %w: raw keys must be valid nats subjects", key, nats.ErrInvalidKey)
+	}
+	if n.SoftDelete && isTombstone(nkey) {
+		return fmt.Errorf("store %v: %w: the prefix %v holds tombstones", key, nats.ErrInvalidKey, strings.TrimSuffix(tombstonePrefix, "."))
+	}
+
+	maxTokens := maxKeyTokens
+	if n.MaxKeyTokens > 0 {
+		maxTokens = n.MaxKeyTokens
+	}
+	if tokens := strings.Count(nkey, ".") + 1; len(nkey) > maxKeyLength || tokens > maxTokens {
+		return fmt.Errorf("store %v: %w: normalized to %d characters in %d tokens, limits are %d characters and %d tokens",
+			key, ErrKeyTooLong, len(nkey), tokens, maxKeyLength, maxTokens)
+	}
+
+	if n.MaxPayload > 0 && int64(len(value)) > n.MaxPayload {
+		return fmt.Errorf("store %v: %w: %d bytes exceeds limit of %d bytes", key, ErrPayloadTooLarge, len(value), n.MaxPayload)
+	}
+	return nil
+}
+
+func (n *Nats) Load(ctx context.Context, key string) ([]byte, error) {
+	if t, err := n.tenant(ctx); err != nil {
+		return nil, err
+	} else if t != nil {
+		return t.Load(ctx, key)
+	}
+	span := n.startSpan(ctx, "Load", key)
+	value, err := n.load(ctx, key, true)
+	endSpan(span, len(value), err)
+	return value, err
+}
+
+// load loads key, a missing key is served from DefaultsFor if defaults
+// is set.
+func (n *Nats) load(ctx context.Context, key string, defaults bool) ([]byte, error) {
+	n.logger.Info(fmt.Sprintf("Load: %v", key))
+	if fb := n.fallback(); fb != nil {
+		return fb.Load(ctx, key)
+	}
+
+	if value, ok := n.memCache.get(n.natsKey(key)); ok {
+		return value, nil
+	}
+	if value, ok := n.hotCache.get(ctx, n.natsKey(key)); ok {
+		return value, nil
+	}
+	gen := n.memCache.generation()
+
+	var value []byte
+	err := n.run("Load", key, func() error {
+		return n.retryRead(ctx, func() error {
+			if n.Checksum {
+				// the checksum is only available from the raw message
+				msg, err := n.lastMsg(n.natsKey(key))
+				if err != nil {
+					return err
+				}
+				if err := verifyChecksum(msg.Data, msg.Header); err != nil {
+					return fmt.Errorf("load %v: %w", key, err)
+				}
+				value = msg.Data
+				n.seenRev(n.natsKey(key), msg.Sequence)
+				return nil
+			}
+
+			kv, _ := n.reader()
+			k, err := kv.Get(n.natsKey(key))
+			if err != nil {
+				return err
+			}
+			value = k.Value()
+			n.seenRev(k.Key(), k.Revision())
+			return nil
+		})
+	})
+	if errors.Is(err, ErrChecksumMismatch) {
+		return n.recoverValue(key, err)
+	}
+	if err != nil {
+		if isKeyNotFound(err) {
+			if value, ok := n.defaultFor(key); ok && defaults {
+				return value, nil
+			}
+			return nil, fs.ErrNotExist
+		}
+
+		return nil, err
+	}
+
+	value, err = n.decodeValue(value)
+	if err != nil {
+		return n.recoverValue(key, err)
+	}
+	n.memCache.put(n.natsKey(key), value, gen)
+	return value, nil
+}
+
+// LoadRange returns length bytes of the value of key starting at
+// offset, fewer if the value ends before. KV entries can only be read
+// whole, so the value is loaded and sliced.
+func (n *Nats) LoadRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("load range %v: invalid range %d+%d", key, offset, length)
+	}
+
+	value, err := n.Load(ctx, key)
+	if err != nil {
 		return nil, err
 	}
 
-	return k.Value(), nil
+	size := int64(len(value))
+	if offset >= size {
+		return []byte{}, nil
+	}
+	return value[offset:min(offset+length, size)], nil
+}
+
+// Modified returns when key was last written. Only the entry metadata
+// is fetched, not the value.
+func (n *Nats) Modified(ctx context.Context, key string) (time.Time, error) {
+	n.logger.Info(fmt.Sprintf("Modified: %v", key))
+	if fb := n.fallback(); fb != nil {
+		ki, err := fb.Stat(ctx, key)
+		return ki.Modified, err
+	}
+
+	var modified time.Time
+	err := n.run("Modified", key, func() error {
+		kv, _ := n.reader()
+		watcher, err := kv.Watch(n.natsKey(key), nats.MetaOnly(), nats.IgnoreDeletes(), nats.Context(ctx))
+		if err != nil {
+			return err
+		}
+		defer watcher.Stop()
+
+		entry := <-watcher.Updates()
+		if entry == nil {
+			return nats.ErrKeyNotFound
+		}
+		modified = entry.Created()
+		return nil
+	})
+	if isKeyNotFound(err) {
+		return time.Time{}, fs.ErrNotExist
+	}
+	return modified, err
 }
 
+// DeleteOlderThan deletes the keys below prefix which weren't written
+// for longer than age and returns how many were deleted, e.g. with
+// prefix "LOCK" to prune stale locks. Like locks and tombstones the
+// prefixes "LOCK" and "TOMBSTONE" are not below KeyPrefix. An empty
+// prefix is rejected so live certificates aren't pruned by accident.
+// Hashed keys are skipped.
+func (n *Nats) DeleteOlderThan(ctx context.Context, prefix string, age time.Duration) (int, error) {
+	n.logger.Info(fmt.Sprintf("DeleteOlderThan: %v, %v", prefix, age))
+	oprefix := canonicalPrefix(n.canonicalKey(prefix))
+	if oprefix == "" {
+		return 0, fmt.Errorf("delete older than: a prefix is required")
+	}
+
+	var stale []string
+	cutoff := time.Now().Add(-age)
+	err := n.run("DeleteOlderThan", oprefix, func() error {
+		kv, _ := n.writer()
+		watcher, err := kv.Watch(n.pruneFilter(oprefix), nats.MetaOnly(), nats.IgnoreDeletes(), nats.Context(ctx))
+		if err != nil {
+			return err
+		}
+		defer watcher.Stop()
+
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				break
+			}
+			if entry.Created().Before(cutoff) {
+				stale = append(stale, entry.Key())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n.listCache.invalidate(oprefix + "/")
+	var deleted int
+	for _, nkey := range stale {
+		n.memCache.invalidate(nkey)
+		n.hotCache.invalidate(nkey)
+		err := n.runWrite("DeleteOlderThan", nkey, func() error {
+			kv, _ := n.writer()
+			return kv.Delete(nkey)
+		})
+		if err != nil && !isKeyNotFound(err) {
+			return deleted, err
+		}
+		if err == nil {
+			// keys deleted by someone else since aren't counted
+			deleted++
+		}
+		err = n.mirror("DeleteOlderThan", nkey, func(kv nats.KeyValue, _ nats.JetStreamContext) error {
+			if err := kv.Delete(nkey); !isKeyNotFound(err) {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// pruneFilter returns the key filter of DeleteOlderThan for prefix.
+// Locks and tombstones are stored outside of KeyPrefix.
+func (n *Nats) pruneFilter(prefix string) string {
+	switch first, _, _ := strings.Cut(prefix, "/"); first {
+	case "LOCK", strings.TrimSuffix(tombstonePrefix, "."):
+		return n.normalize(n.obfuscate(prefix)) + ".>"
+	}
+	return n.watchFilter(prefix)
+}
+
+// defaultFor returns the DefaultsFor value of the longest prefix
+// matching key.
+func (n *Nats) defaultFor(key string) ([]byte, bool) {
+	var value []byte
+	longest := -1
+	for prefix, v := range n.DefaultsFor {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			value, longest = v, len(prefix)
+		}
+	}
+	return value, longest >= 0
+}
+
+// Delete deletes key. Deleting a key which doesn't exist succeeds.
 func (n *Nats) Delete(ctx context.Context, key string) error {
+	if t, err := n.tenant(ctx); err != nil {
+		return err
+	} else if t != nil {
+		return t.Delete(ctx, key)
+	}
+	span := n.startSpan(ctx, "Delete", key)
+	err := n.remove(ctx, key)
+	endSpan(span, -1, err)
+	return err
+}
+
+func (n *Nats) remove(ctx context.Context, key string) error {
 	n.logger.Info(fmt.Sprintf("Delete: %v", key))
-	return n.Client.Delete(normalizeNatsKey(key))
+	if fb := n.fallback(); fb != nil {
+		return fb.Delete(ctx, key)
+	}
+
+	n.listCache.invalidate(n.canonicalKey(key))
+	n.memCache.invalidate(n.natsKey(key))
+	n.hotCache.invalidate(n.natsKey(key))
+	err := n.runWrite("Delete", key, func() error {
+		if n.SoftDelete {
+			if err := n.tombstone(key); err != nil {
+				return err
+			}
+		}
+		kv, _ := n.writer()
+		return kv.Delete(n.natsKey(key))
+	})
+	// deleting a key that is already gone is not an error
+	if err != nil && !isKeyNotFound(err) {
+		return err
+	}
+
+	return n.mirror("Delete", key, func(kv nats.KeyValue, _ nats.JetStreamContext) error {
+		if err := kv.Delete(n.natsKey(key)); !isKeyNotFound(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Rename moves the value of oldKey to newKey. If oldKey can't be
+// deleted after the copy, newKey is restored on a best-effort basis.
+// It returns fs.ErrNotExist if oldKey doesn't exist and fails if both
+// keys are stored under the same name.
+func (n *Nats) Rename(ctx context.Context, oldKey, newKey string) error {
+	if t, err := n.tenant(ctx); err != nil {
+		return err
+	} else if t != nil {
+		return t.Rename(ctx, oldKey, newKey)
+	}
+	n.logger.Info(fmt.Sprintf("Rename: %v, %v", oldKey, newKey))
+	if n.natsKey(oldKey) == n.natsKey(newKey) {
+		return fmt.Errorf("rename %v: %v is the same key", oldKey, newKey)
+	}
+	if !n.Exists(ctx, oldKey) {
+		return fs.ErrNotExist
+	}
+
+	value, err := n.Load(ctx, oldKey)
+	if err != nil {
+		return fmt.Errorf("rename %v: %w", oldKey, err)
+	}
+	// the stored value only, a default must not be written back
+	prev, prevErr := n.load(ctx, newKey, false)
+	if prevErr != nil && !errors.Is(prevErr, fs.ErrNotExist) {
+		return fmt.Errorf("rename %v: loading %v: %w", oldKey, newKey, prevErr)
+	}
+	if err := n.Store(ctx, newKey, value); err != nil {
+		return fmt.Errorf("rename %v: %w", oldKey, err)
+	}
+
+	if err := n.Delete(ctx, oldKey); err != nil {
+		var rerr error
+		if prevErr == nil {
+			rerr = n.Store(ctx, newKey, prev)
+		} else {
+			rerr = n.Delete(ctx, newKey)
+		}
+		if rerr != nil {
+			n.logger.Error(fmt.Sprintf("Rename: rolling back %v: %v", newKey, rerr))
+		}
+		return fmt.Errorf("rename %v: %w", oldKey, err)
+	}
+	return nil
+}
+
+// CopyPrefix copies every key below srcPrefix to the same relative key
+// below dstPrefix, loading one value at a time, and returns the number
+// of keys copied. Existing destination keys are kept unless overwrite
+// is set. A List truncated by ListLimit copies nothing.
+func (n *Nats) CopyPrefix(ctx context.Context, srcPrefix, dstPrefix string, overwrite bool) (int, error) {
+	n.logger.Info(fmt.Sprintf("CopyPrefix: %v, %v", srcPrefix, dstPrefix))
+	if fb := n.fallback(); fb != nil {
+		return 0, fmt.Errorf("copy %v: %w", srcPrefix, ErrNotConnected)
+	}
+
+	keys, oprefix, err := n.keys(ctx, "CopyPrefix", srcPrefix, false)
+	if err != nil {
+		return 0, fmt.Errorf("copy %v: %w", srcPrefix, err)
+	}
+	dprefix := canonicalPrefix(n.canonicalKey(dstPrefix))
+
+	var copied int
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+
+		dst := path.Join(dprefix, strings.TrimPrefix(strings.TrimPrefix(key, oprefix), "/"))
+		if !overwrite && n.Exists(ctx, dst) {
+			continue
+		}
+		value, err := n.Load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return copied, fmt.Errorf("copy %v: %w", key, err)
+		}
+		if err := n.Store(ctx, dst, value); err != nil {
+			return copied, fmt.Errorf("copy %v to %v: %w", key, dst, err)
+		}
+		copied++
+	}
+	return copied, nil
 }
 
 func (n *Nats) Exists(ctx context.Context, key string) bool {
+	if t, err := n.tenant(ctx); err != nil {
+		return false
+	} else if t != nil {
+		return t.Exists(ctx, key)
+	}
 	n.logger.Info(fmt.Sprintf("Exists: %v", key))
-	_, err := n.Client.Get(normalizeNatsKey(key))
+	if fb := n.fallback(); fb != nil {
+		return fb.Exists(ctx, key)
+	}
+	if _, ok := n.memCache.get(n.natsKey(key)); ok {
+		return true
+	}
+
+	err := n.run("Exists", key, func() error {
+		return n.retryRead(ctx, func() error {
+			kv, _ := n.reader()
+			if n.ExistsMetaOnly {
+				return keyPresent(ctx, kv, n.natsKey(key))
+			}
+			_, err := kv.Get(n.natsKey(key))
+			return err
+		})
+	})
 	return err == nil
 }
 
+// keyPresent checks that nkey has a value reading only the headers of
+// its latest revision, failing with nats.ErrKeyNotFound if it doesn't
+// or was deleted or purged.
+func keyPresent(ctx context.Context, kv nats.KeyValue, nkey string) error {
+	watcher, err := kv.Watch(nkey, nats.MetaOnly(), nats.IgnoreDeletes(), nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	// the first update is the latest revision, nil if there is none
+	if entry, ok := <-watcher.Updates(); ok && entry != nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return nats.ErrKeyNotFound
+}
+
+// List returns the keys below prefix. Trailing slashes of prefix are
+// ignored, so "dir" and "dir/" list the same keys and "" lists all.
 func (n *Nats) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if t, err := n.tenant(ctx); err != nil {
+		return nil, err
+	} else if t != nil {
+		return t.List(ctx, prefix, recursive)
+	}
 	n.logger.Info(fmt.Sprintf("List: %v, %v", prefix, recursive))
-	oprefix := strings.TrimSuffix(prefix, "/")
-	prefix = normalizeNatsKey(prefix)
+	span := n.startSpan(ctx, "List", prefix)
+	var keys []string
+	var err error
+	if fb := n.fallback(); fb != nil {
+		keys, err = fb.List(ctx, prefix, recursive)
+	} else {
+		keys, err = n.cachedList(ctx, prefix, recursive)
+		if err == nil && len(keys) == 0 && n.ListMissingIsError {
+			err = fmt.Errorf("list %v: %w", prefix, fs.ErrNotExist)
+		}
+	}
+	endSpan(span, -1, err)
+	return keys, err
+}
 
-	if len(prefix) > 1 && prefix[len(prefix)-1] != '.' {
-		prefix += "."
+// cachedList serves List from listCache if possible.
+func (n *Nats) cachedList(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	cprefix := canonicalPrefix(n.canonicalKey(prefix))
+	if keys, ok := n.listCache.get(cprefix, recursive); ok {
+		return keys, nil
 	}
 
-	prefix += ">"
+	keys, err := n.list(ctx, "List", prefix, recursive, false)
+	if err == nil {
+		n.listCache.put(cprefix, recursive, keys)
+	}
+	return keys, err
+}
 
-	watcher, err := n.Client.Watch(prefix, nats.IgnoreDeletes(), nats.MetaOnly(), nats.Context(ctx))
-	if err != nil {
+// ListAll behaves like List but also returns keys whose latest revision
+// is a delete or purge and which only linger in the bucket history.
+// Deleted hashed keys can't be named anymore and are left out.
+func (n *Nats) ListAll(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	n.logger.Info(fmt.Sprintf("ListAll: %v, %v", prefix, recursive))
+	return n.list(ctx, "ListAll", prefix, recursive, true)
+}
+
+func (n *Nats) list(ctx context.Context, op, prefix string, recursive, includeDeleted bool) ([]string, error) {
+	keys, oprefix, err := n.keys(ctx, op, prefix, includeDeleted)
+	if err != nil && !errors.Is(err, ErrListTruncated) {
 		return nil, err
 	}
-	defer watcher.Stop()
 
-	var keys []string
-	for entry := range watcher.Updates() {
-		if entry == nil {
-			break
+	if recursive {
+		return n.formatKeys(keys), err
+	}
+
+	return n.formatKeys(children(keys, oprefix, false)), err
+}
+
+// keys returns all certmagic keys below prefix along with the canonical
+// prefix. When ListLimit is hit the gathered
+// keys are returned with ErrListTruncated.
+func (n *Nats) keys(ctx context.Context, op, prefix string, includeDeleted bool) ([]string, string, error) {
+	oprefix := canonicalPrefix(n.canonicalKey(prefix))
+	prefix = n.watchFilter(oprefix)
+
+	var keys, hashed []string
+	var original map[string]string
+	var truncated bool
+	opts := []nats.WatchOpt{nats.MetaOnly(), nats.Context(ctx)}
+	if !includeDeleted {
+		opts = append(opts, nats.IgnoreDeletes())
+	}
+
+	add := func(nkey string) bool {
+		if (n.HashKeysLongerThan > 0 && isHashedKey(nkey)) || (n.SoftDelete && isTombstone(nkey)) {
+			return true
+		}
+		if n.ListLimit > 0 && len(keys) >= n.ListLimit {
+			truncated = true
+			return false
+		}
+		keys = append(keys, nkey)
+		return true
+	}
+
+	err := n.run(op, oprefix, func() error {
+		kv, js := n.reader()
+		if n.ListBatchSize > 0 {
+			if err := pageKeys(ctx, kv, js, prefix, n.ListBatchSize, includeDeleted, add); err != nil {
+				return err
+			}
+		} else {
+			watcher, err := kv.Watch(prefix, opts...)
+			if err != nil {
+				return err
+			}
+			defer watcher.Stop()
+
+			for entry := range watcher.Updates() {
+				if entry == nil || !add(entry.Key()) {
+					break
+				}
+			}
 		}
 
-		keys = append(keys, entry.Key())
+		var err error
+		if n.ObfuscateKeysSecret != "" {
+			if original, err = originalKeys(ctx, kv, js, prefix); err != nil {
+				return err
+			}
+		}
+		if n.HashKeysLongerThan > 0 {
+			hashed, err = n.listHashed(ctx, oprefix)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, oprefix, err
 	}
 
-	for k := range keys {
-		keys[k] = denormalizeNatsKey(keys[k])
+	valid := keys[:0]
+	for _, nkey := range keys {
+		key := n.denormalize(nkey)
+		if original != nil && isObfuscated(nkey) {
+			if key = original[nkey]; key == "" {
+				continue
+			}
+		}
+		key, ok := n.stripPrefix(key)
+		if !ok {
+			continue
+		}
+		if n.InvalidKeys != InvalidKeysKeep && !wellFormedKey(key) {
+			if n.InvalidKeys == InvalidKeysError {
+				return nil, oprefix, fmt.Errorf("list %v: %w: %q stored as %q", oprefix, ErrInvalidStoredKey, key, nkey)
+			}
+			n.logger.Warn(fmt.Sprintf("List: skipping %q stored as %q, not a valid key", key, nkey))
+			continue
+		}
+		valid = append(valid, key)
+	}
+	keys = append(valid, hashed...)
+	if n.ListLimit > 0 && len(keys) > n.ListLimit {
+		keys = keys[:n.ListLimit]
+		truncated = true
 	}
 
-	if recursive {
-		return keys, nil
+	if truncated {
+		err = fmt.Errorf("list %v: %w at %d keys", oprefix, ErrListTruncated, n.ListLimit)
+	}
+	return keys, oprefix, err
+}
+
+// ListDirs returns the immediate children of prefix which have keys
+// below them, i.e. the directories a non-recursive List would mix in
+// with the leaf keys. Like List, the full paths are returned.
+func (n *Nats) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	n.logger.Info(fmt.Sprintf("ListDirs: %v", prefix))
+	var (
+		keys    []string
+		oprefix string
+		err     error
+	)
+	if fb := n.fallback(); fb != nil {
+		oprefix = canonicalPrefix(prefix)
+		keys, err = fb.List(ctx, prefix, true)
+	} else {
+		keys, oprefix, err = n.keys(ctx, "ListDirs", prefix, false)
+	}
+	if err != nil && !errors.Is(err, ErrListTruncated) {
+		return nil, err
 	}
 
-	dirs := make(map[string]struct{})
-	for k := range keys {
-		paths := strings.Split(keys[k], "/")
-		var dir string
-		for i := range paths {
-			dir += paths[i]
-			if path.Dir(dir) == oprefix {
-				dirs[dir] = struct{}{}
+	return n.formatKeys(children(keys, oprefix, true)), err
+}
+
+// canonicalPrefix strips trailing slashes from a List prefix, so "dir",
+// "dir/" and "dir//" all list the keys below dir. "" and "/" list
+// all keys. A key equal to the prefix itself is not below it.
+func canonicalPrefix(prefix string) string {
+	return strings.TrimRight(prefix, "/")
+}
+
+// children returns the sorted, deduplicated immediate children of the
+// canonical prefix among keys. With dirsOnly, leaf keys directly below
+// prefix are left out.
+func children(keys []string, prefix string, dirsOnly bool) []string {
+	set := make(map[string]struct{})
+	for _, key := range keys {
+		rel := key
+		if prefix != "" {
+			if !strings.HasPrefix(key, prefix+"/") {
+				continue
 			}
-			dir += "/"
+			rel = strings.TrimPrefix(key, prefix+"/")
+		}
+
+		child, _, dir := strings.Cut(rel, "/")
+		if dirsOnly && !dir {
+			continue
 		}
+		set[path.Join(prefix, child)] = struct{}{}
+	}
+
+	result := make([]string, 0, len(set))
+	for k := range set {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// formatKeys converts certmagic keys returned by List to ListFormat.
+func (n *Nats) formatKeys(keys []string) []string {
+	if n.ListFormat != ListFormatNats {
+		return keys
+	}
+
+	for i := range keys {
+		keys[i] = n.natsKey(keys[i])
+	}
+	return keys
+}
+
+// watchFilter returns the kv key filter matching all keys below the
+// canonical certmagic prefix.
+func (n *Nats) watchFilter(prefix string) string {
+	prefix = n.prefixed(prefix)
+	if prefix == "" {
+		return ">"
+	}
+	return n.normalize(n.obfuscate(prefix)) + ".>"
+}
+
+// listHashed returns the original names of all hashed keys below prefix.
+func (n *Nats) listHashed(ctx context.Context, prefix string) ([]string, error) {
+	kv, _ := n.reader()
+	watcher, err := kv.Watch(hashedKeyPrefix+">", nats.IgnoreDeletes(), nats.MetaOnly(), nats.Context(ctx))
+	if err != nil {
+		return nil, err
 	}
+	defer watcher.Stop()
+
+	var keys []string
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+
+		key, err := n.originalKey(entry.Key())
+		if err != nil {
+			return nil, err
+		}
 
-	dkeys := make([]string, 0, len(dirs))
-	for k := range dirs {
-		dkeys = append(dkeys, k)
+		key, ok := n.stripPrefix(key)
+		if ok && (prefix == "" || strings.HasPrefix(key, prefix+"/")) {
+			keys = append(keys, key)
+		}
 	}
 
-	return dkeys, nil
+	return keys, nil
 }
 
 func (n *Nats) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if t, err := n.tenant(ctx); err != nil {
+		return certmagic.KeyInfo{}, err
+	} else if t != nil {
+		return t.Stat(ctx, key)
+	}
 	n.logger.Info(fmt.Sprintf("Stat: %v", key))
+	if fb := n.fallback(); fb != nil {
+		return fb.Stat(ctx, key)
+	}
+
 	var ki certmagic.KeyInfo
 
-	key = strings.TrimSuffix(key, "/")
-	nkey := normalizeNatsKey(key)
-	k, err := n.Client.Get(nkey)
-	if err == nats.ErrKeyNotFound {
-		entries, err := n.List(ctx, nkey, false)
-		if err != nil {
+	key = canonicalPrefix(key)
+	var (
+		size     int64
+		modified time.Time
+	)
+	err := n.run("Stat", key, func() error {
+		return n.retryRead(ctx, func() error {
+			// only the headers are read, the value is loaded when they
+			// don't tell its size
+			nkey := n.natsKey(key)
+			msgs, err := storeOf(n.reader()).LastMsgs(ctx, nkey)
+			if err != nil {
+				return err
+			}
+			msg, ok := msgs[nkey]
+			if !ok {
+				return nats.ErrKeyNotFound
+			}
+			switch msg.Header.Get("KV-Operation") {
+			case "DEL", "PURGE":
+				return nats.ErrKeyDeleted
+			}
+
+			size, err = n.listedSize(nkey, msg)
+			modified = msg.Time
+			return err
+		})
+	})
+	if isKeyNotFound(err) {
+		entries, err := n.List(ctx, key, false)
+		if err != nil && !errors.Is(err, ErrListTruncated) {
 			return ki, fs.ErrNotExist
 		}
 
@@ -291,8 +2367,8 @@ func (n *Nats) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error)
 	}
 
 	ki.Key = key
-	ki.Size = int64(len(k.Value()))
-	ki.Modified = k.Created()
+	ki.Size = size
+	ki.Modified = modified
 	ki.IsTerminal = true
 	return ki, nil
 }
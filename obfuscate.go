@@ -0,0 +1,70 @@
+package certmagic_nats
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// obfuscatedMarker starts the key segments replaced by their HMAC.
+// Domain names never start with it.
+const obfuscatedMarker = "="
+
+// obfuscate replaces the domain name and email address segments of key,
+// e.g. of ACME accounts, with an HMAC of them under ObfuscateKeysSecret,
+// so subjects don't reveal the domains. Other segments such as
+// "certificates" are kept, prefixes of obfuscated keys still match.
+func (n *Nats) obfuscate(key string) string {
+	if n.ObfuscateKeysSecret == "" {
+		return key
+	}
+
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		if isDomainLike(parts[i]) || isEmailLike(parts[i]) {
+			mac := hmac.New(sha256.New, []byte(n.ObfuscateKeysSecret))
+			mac.Write([]byte(parts[i]))
+			parts[i] = obfuscatedMarker + hex.EncodeToString(mac.Sum(nil)[:16])
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// isEmailLike reports whether segment is an email address, a local part
+// followed by @ and a domain name.
+func isEmailLike(segment string) bool {
+	local, domain, ok := strings.Cut(segment, "@")
+	return ok && local != "" && isDomainLike(domain)
+}
+
+// isObfuscated reports whether nkey has segments replaced by obfuscate.
+func isObfuscated(nkey string) bool {
+	for _, token := range strings.FieldsFunc(nkey, func(r rune) bool { return r == '.' || r == '/' }) {
+		if strings.HasPrefix(token, obfuscatedMarker) {
+			return true
+		}
+	}
+	return false
+}
+
+// originalKeys reads the certmagic keys stored alongside the obfuscated
+// keys matching filter, keyed by their nats key. Keys whose latest
+// message carries no key, i.e. delete markers, are left out.
+func originalKeys(ctx context.Context, kv nats.KeyValue, js nats.JetStreamContext, filter string) (map[string]string, error) {
+	msgs, err := storeOf(kv, js).LastMsgs(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string, len(msgs))
+	for nkey, msg := range msgs {
+		if key := msg.Header.Get(keyHeader); key != "" && isObfuscated(nkey) {
+			keys[nkey] = key
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,98 @@
+package certmagic_nats
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrReadOnly is returned by writes while the instance is read only
+// after repeated write failures. Reads are still served.
+var ErrReadOnly = errors.New("nats storage is read only after repeated write failures")
+
+// defaultReadOnlyProbeInterval is how often a write is let through to
+// probe the storage when ReadOnlyProbeInterval isn't set.
+const defaultReadOnlyProbeInterval = 10 * time.Second
+
+// readOnly refuses writes after threshold consecutive write failures,
+// letting one through every probe interval until a write succeeds. A
+// nil readOnly never refuses writes.
+type readOnly struct {
+	threshold int
+	probe     time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	lastProbe time.Time
+}
+
+func newReadOnly(threshold int, probe time.Duration) *readOnly {
+	if threshold <= 0 {
+		return nil
+	}
+	if probe <= 0 {
+		probe = defaultReadOnlyProbeInterval
+	}
+	return &readOnly{threshold: threshold, probe: probe}
+}
+
+// allow returns ErrReadOnly while writes are refused.
+func (r *readOnly) allow() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures < r.threshold {
+		return nil
+	}
+	if time.Since(r.lastProbe) >= r.probe {
+		r.lastProbe = time.Now()
+		return nil
+	}
+	return fmt.Errorf("%w, probing again after %v", ErrReadOnly, r.lastProbe.Add(r.probe).Format(time.RFC3339))
+}
+
+// record tracks the outcome of a write, reporting whether it made the
+// instance read only or writable again.
+func (r *readOnly) record(err error) (entered, left bool) {
+	if r == nil {
+		return false, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !isFailure(err) {
+		left = r.failures >= r.threshold
+		r.failures = 0
+		return false, left
+	}
+
+	r.failures++
+	if r.failures == r.threshold {
+		r.lastProbe = time.Now()
+		return true, false
+	}
+	return false, false
+}
+
+// runWrite runs a write like run, refusing it with ErrReadOnly while
+// the instance is read only.
+func (n *Nats) runWrite(op, key string, fn func() error) error {
+	if err := n.readOnly.allow(); err != nil {
+		return fmt.Errorf("%s %v: %w", op, key, err)
+	}
+
+	err := n.run(op, key, fn)
+	switch entered, left := n.readOnly.record(err); {
+	case entered:
+		n.logger.Error(fmt.Sprintf("CRITICAL: %v consecutive writes failed, switching to read only, last error: %v", n.ReadOnlyAfter, err))
+		n.notifyConn("read_only", "", err)
+	case left:
+		n.logger.Warn("Writes succeed again, leaving read only mode")
+		n.notifyConn("writable", "", nil)
+	}
+	return err
+}
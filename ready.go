@@ -0,0 +1,46 @@
+package certmagic_nats
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// readyPoll is how often Ready checks the connection.
+const readyPoll = 50 * time.Millisecond
+
+// Ready blocks until the connection is up and the bucket answers, or
+// ctx is done, so modules depending on the storage can wait for it
+// instead of hitting the fallback storage or ErrNotConnected during
+// startup. It returns the error of the last check with ctx's error.
+func (n *Nats) Ready(ctx context.Context) error {
+	ticker := time.NewTicker(readyPoll)
+	defer ticker.Stop()
+
+	for {
+		err := n.ready()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ready checks once that the bucket is usable.
+func (n *Nats) ready() error {
+	kv, _ := n.writer()
+	if nc, _ := n.conns(); kv == nil || nc == nil || !nc.IsConnected() {
+		return ErrNotConnected
+	}
+	// binding only happens on connect, make sure the bucket still
+	// exists and JetStream answers
+	if _, err := kv.Status(); err != nil {
+		return fmt.Errorf("bucket %v: %w", kv.Bucket(), err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package certmagic_nats
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// selfTestPrefix namespaces the keys written by SelfTest.
+const selfTestPrefix = "selftest/"
+
+// SelfTest stores a temporary key, reads it back and deletes it, to
+// confirm the storage works end to end, e.g. from a health check.
+func (n *Nats) SelfTest(ctx context.Context) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("self test: %w", err)
+	}
+	key := selfTestPrefix + hex.EncodeToString(token)
+	value := []byte("caddy-nats-storage self test " + key)
+
+	if err := n.Store(ctx, key, value); err != nil {
+		return fmt.Errorf("self test: store %v: %w", key, err)
+	}
+
+	got, err := n.Load(ctx, key)
+	if err != nil {
+		n.Delete(ctx, key)
+		return fmt.Errorf("self test: load %v: %w", key, err)
+	}
+	if !bytes.Equal(got, value) {
+		n.Delete(ctx, key)
+		return fmt.Errorf("self test: loaded %d bytes from %v, which differ from the %d bytes stored", len(got), key, len(value))
+	}
+
+	if err := n.Delete(ctx, key); err != nil {
+		return fmt.Errorf("self test: delete %v: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package certmagic_nats
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var validBucket = regexp.MustCompile(`^[-_a-zA-Z0-9]+$`)
+
+// tenant returns the instance serving the bucket named by the value of
+// BucketContextKey in ctx, nil if the configured bucket applies. The
+// instances are provisioned with the same settings on first use and
+// kept until Cleanup.
+func (n *Nats) tenant(ctx context.Context) (*Nats, error) {
+	if n.BucketContextKey == "" {
+		return nil, nil
+	}
+	bucket, _ := ctx.Value(caddy.CtxKey(n.BucketContextKey)).(string)
+	if bucket == "" || bucket == n.Bucket {
+		return nil, nil
+	}
+	if !validBucket.MatchString(bucket) {
+		return nil, fmt.Errorf("invalid bucket %q in context key %v", bucket, n.BucketContextKey)
+	}
+
+	n.tenantLock.Lock()
+	defer n.tenantLock.Unlock()
+	if t, ok := n.tenants[bucket]; ok {
+		return t, nil
+	}
+
+	t := n.tenantConfig(bucket)
+	if err := t.Provision(n.caddyCtx); err != nil {
+		return nil, fmt.Errorf("bucket %v from context: %w", bucket, err)
+	}
+	if n.tenants == nil {
+		n.tenants = make(map[string]*Nats)
+	}
+	n.tenants[bucket] = t
+	n.logger.Info(fmt.Sprintf("Serving bucket %v from context key %v", bucket, n.BucketContextKey))
+	return t, nil
+}
+
+// tenantConfig copies the settings of n for an instance on bucket.
+// Settings naming other buckets don't carry over, with BucketConfig
+// the bucket is created if missing. HotCacheSubject does, the hot cache
+// subjects include the bucket so tenants never serve each other.
+func (n *Nats) tenantConfig(bucket string) *Nats {
+	t := &Nats{}
+	src, dst := reflect.ValueOf(n).Elem(), reflect.ValueOf(t).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+
+	t.Client = nil
+	t.Bucket = bucket
+	t.BucketContextKey = ""
+	t.ReadBucket, t.MirrorBucket, t.Failover = "", "", nil
+	// the fallback is already provisioned and shared
+	t.FallbackRaw = nil
+	if n.BucketConfig != nil {
+		cfg := *n.BucketConfig
+		cfg.Bucket = bucket
+		t.BucketConfig = &cfg
+	}
+	return t
+}
+
+// cleanupTenants cleans up the instances started by tenant.
+func (n *Nats) cleanupTenants() {
+	n.tenantLock.Lock()
+	defer n.tenantLock.Unlock()
+	for _, t := range n.tenants {
+		t.Cleanup()
+	}
+	n.tenants = nil
+}
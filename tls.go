@@ -0,0 +1,47 @@
+package certmagic_nats
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// validateTLS checks the client certificate files are configured
+// together and tls_first isn't used with websocket hosts.
+func (n *Nats) validateTLS() error {
+	if (n.CertFile == "") != (n.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if n.TLSFirst && (hasWebsocketHost(n.Hosts) || hasWebsocketHost(n.ReadHosts)) {
+		return fmt.Errorf("tls_first can't be used with ws:// or wss:// hosts")
+	}
+	return nil
+}
+
+// hasWebsocketHost reports whether any of the comma separated hosts is
+// a websocket URL.
+func hasWebsocketHost(hosts string) bool {
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if strings.HasPrefix(host, "ws://") || strings.HasPrefix(host, "wss://") {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the TLS config for the client certificate. The
+// certificate is read from disk on every handshake, so a rotated
+// certificate is used on the next reconnect without a restart.
+func (n *Nats) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(n.CertFile, n.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			return &cert, nil
+		},
+	}
+}
@@ -0,0 +1,157 @@
+package certmagic_nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// tombstonePrefix holds the values of soft deleted keys
+	tombstonePrefix = "TOMBSTONE."
+	// deletedHeader carries the time a tombstone was written
+	deletedHeader = "Caddy-Deleted"
+)
+
+// isTombstone reports whether nkey holds a soft deleted value.
+func isTombstone(nkey string) bool {
+	return strings.HasPrefix(nkey, tombstonePrefix)
+}
+
+// lastWritten returns the raw message holding the latest value of nkey
+// on the write connection.
+func (n *Nats) lastWritten(nkey string) (*nats.RawStreamMsg, error) {
+	kv, js := n.writer()
+	return lastMsgIn(kv, js, nkey)
+}
+
+// tombstone copies the stored value of key, headers included, to its
+// tombstone along with the time of deletion. A missing key has nothing
+// to keep.
+func (n *Nats) tombstone(key string) error {
+	nkey := n.natsKey(key)
+	msg, err := n.lastWritten(nkey)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	kv, js := n.writer()
+	stone := nats.NewMsg(kvSubject(kv, tombstonePrefix+nkey))
+	for k, v := range msg.Header {
+		if !isServerHeader(k) {
+			stone.Header[k] = v
+		}
+	}
+	stone.Header.Set(deletedHeader, time.Now().UTC().Format(time.RFC3339Nano))
+	stone.Data = msg.Data
+
+	_, err = storeOf(kv, js).PublishMsg(stone)
+	return err
+}
+
+// Undelete restores a key removed while SoftDelete was set. It returns
+// fs.ErrNotExist if there is no tombstone for key or, with
+// SoftDeleteWindow set, it was deleted longer ago than the window, and
+// fs.ErrExist if key was stored again since it was deleted.
+func (n *Nats) Undelete(ctx context.Context, key string) error {
+	n.logger.Info(fmt.Sprintf("Undelete: %v", key))
+	nkey := n.natsKey(key)
+
+	var stone *nats.RawStreamMsg
+	err := n.run("Undelete", key, func() (err error) {
+		stone, err = n.lastWritten(tombstonePrefix + nkey)
+		return err
+	})
+	if err != nil {
+		if isKeyNotFound(err) {
+			return fs.ErrNotExist
+		}
+		return err
+	}
+
+	deleted, err := time.Parse(time.RFC3339Nano, stone.Header.Get(deletedHeader))
+	if err != nil {
+		return fmt.Errorf("undelete %v: invalid tombstone: %w", key, err)
+	}
+	if window := time.Duration(n.SoftDeleteWindow); window > 0 && time.Since(deleted) > window {
+		return fmt.Errorf("undelete %v: deleted %v ago, outside the window of %v: %w", key, time.Since(deleted).Round(time.Second), window, fs.ErrNotExist)
+	}
+
+	// the restore is pinned to the delete marker, a value stored since
+	// the delete wins over the tombstone
+	var last uint64
+	var live bool
+	err = n.run("Undelete", key, func() error {
+		msg, err := storeOf(n.writer()).GetLastMsg(nkey)
+		switch {
+		case err == nil:
+			last = msg.Sequence
+			op := msg.Header.Get("KV-Operation")
+			live = op != "DEL" && op != "PURGE"
+		case !errors.Is(err, nats.ErrMsgNotFound):
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if live {
+		return fmt.Errorf("undelete %v: stored again since the delete: %w", key, fs.ErrExist)
+	}
+
+	n.listCache.invalidate(n.canonicalKey(key))
+	n.memCache.invalidate(nkey)
+	n.hotCache.invalidate(nkey)
+	err = n.runWrite("Undelete", key, func() error {
+		kv, js := n.writer()
+		store := storeOf(kv, js)
+		msg := restored(kv, nkey, stone)
+		msg.Header.Set(nats.ExpectedLastSubjSeqHdr, strconv.FormatUint(last, 10))
+		if _, err := store.PublishMsg(msg); err != nil {
+			return err
+		}
+		return store.Delete(tombstonePrefix + nkey)
+	})
+	if err != nil {
+		if isWrongSequence(err) {
+			return fmt.Errorf("undelete %v: stored again since the delete: %w", key, fs.ErrExist)
+		}
+		return err
+	}
+
+	// the mirror keeps no tombstones, restore the value there directly
+	return n.mirror("Undelete", key, func(kv nats.KeyValue, js nats.JetStreamContext) error {
+		_, err := storeOf(kv, js).PublishMsg(restored(kv, nkey, stone))
+		return err
+	})
+}
+
+// restored returns the message writing the value kept by stone back to
+// nkey in kv.
+func restored(kv nats.KeyValue, nkey string, stone *nats.RawStreamMsg) *nats.Msg {
+	msg := nats.NewMsg(kvSubject(kv, nkey))
+	for k, v := range stone.Header {
+		if k != deletedHeader && !isServerHeader(k) {
+			msg.Header[k] = v
+		}
+	}
+	msg.Data = stone.Data
+	return msg
+}
+
+// isServerHeader reports whether k is a header interpreted or added
+// by the server, e.g. the direct get metadata or a publish
+// expectation, rather than part of the stored value.
+func isServerHeader(k string) bool {
+	return strings.HasPrefix(k, "Nats-")
+}
@@ -0,0 +1,49 @@
+package certmagic_nats
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans of this module.
+const tracerName = "github.com/jordan-rash/caddy-nats-storage"
+
+// startSpan starts a span for op on key using TracerProvider, or the
+// provider of the span in ctx. Without either it returns nil and
+// tracing costs nothing.
+func (n *Nats) startSpan(ctx context.Context, op, key string) trace.Span {
+	tp := n.TracerProvider
+	if tp == nil {
+		parent := trace.SpanFromContext(ctx)
+		if !parent.SpanContext().IsValid() {
+			return nil
+		}
+		tp = parent.TracerProvider()
+	}
+
+	_, span := tp.Tracer(tracerName).Start(ctx, "nats."+op, trace.WithAttributes(
+		attribute.String("storage.key", key),
+		attribute.String("storage.bucket", n.Bucket),
+	))
+	return span
+}
+
+// endSpan records the value size and error of an operation started
+// with startSpan. span may be nil.
+func endSpan(span trace.Span, size int, err error) {
+	if span == nil {
+		return
+	}
+
+	if size >= 0 {
+		span.SetAttributes(attribute.Int("storage.size", size))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,106 @@
+package certmagic_nats
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// lockTTL is how long a lock is held before it counts as stale, a
+// variable so tests can have the server expire locks quickly.
+var lockTTL = 5 * time.Minute
+
+// lockValue encodes the expiry of a lock followed by its holder.
+func lockValue(expires time.Time, holder string) []byte {
+	value := make([]byte, 8, 8+len(holder))
+	binary.LittleEndian.PutUint64(value, uint64(expires.UnixNano()))
+	return append(value, holder...)
+}
+
+// parseLock decodes a lock written by lockValue. Locks written before
+// the holder was recorded only carry the expiry.
+func parseLock(value []byte) (expires time.Time, holder string, ok bool) {
+	if len(value) < 8 {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(value))), string(value[8:]), true
+}
+
+// ttlHeader sets the per message TTL on servers supporting it.
+const ttlHeader = "Nats-TTL"
+
+// detectNativeTTL reports whether the server expires messages by their
+// TTL header, which needs nats-server 2.11 and a bucket stream allowing
+// message TTLs. Locks fall back to their expiry timestamp otherwise.
+func (n *Nats) detectNativeTTL(nc *nats.Conn) bool {
+	var major, minor int
+	if _, err := fmt.Sscanf(nc.ConnectedServerVersion(), "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	if major < 2 || major == 2 && minor < 11 {
+		return false
+	}
+
+	kv, _ := n.writer()
+	if kv == nil {
+		return false
+	}
+
+	// the stream config of this client library doesn't know the setting
+	msg, err := nc.Request("$JS.API.STREAM.INFO."+kvStream(kv), nil, 2*time.Second)
+	if err != nil {
+		return false
+	}
+	var info struct {
+		Config struct {
+			AllowMsgTTL bool `json:"allow_msg_ttl"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(msg.Data, &info); err != nil {
+		return false
+	}
+	return info.Config.AllowMsgTTL
+}
+
+// createLock creates lockKey holding contents. With native TTL support
+// the server deletes the lock once lockTTL and LockStaleGrace passed,
+// even if the holder crashed.
+func (n *Nats) createLock(lockKey string, contents []byte) (uint64, error) {
+	kv, js := n.writer()
+	store := storeOf(kv, js)
+	if !n.nativeTTL {
+		return store.Create(lockKey, contents)
+	}
+
+	var last uint64
+	msg, err := store.GetLastMsg(lockKey)
+	switch {
+	case errors.Is(err, nats.ErrMsgNotFound):
+	case err != nil:
+		return 0, err
+	default:
+		switch msg.Header.Get("KV-Operation") {
+		case "DEL", "PURGE":
+			// create on top of the released lock
+			last = msg.Sequence
+		default:
+			return 0, nats.ErrKeyExists
+		}
+	}
+
+	lock := nats.NewMsg(kvSubject(kv, lockKey))
+	lock.Header.Set(ttlHeader, (lockTTL + time.Duration(n.LockStaleGrace)).String())
+	lock.Header.Set(nats.ExpectedLastSubjSeqHdr, strconv.FormatUint(last, 10))
+	lock.Data = contents
+
+	ack, err := store.PublishMsg(lock)
+	if err != nil {
+		return 0, err
+	}
+	return ack.Sequence, nil
+}
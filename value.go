@@ -0,0 +1,189 @@
+package certmagic_nats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// EncodingRaw stores values as they are passed to Store.
+	EncodingRaw = "raw"
+	// EncodingBase64 stores values base64 encoded, which keeps them
+	// readable when inspected with the nats cli.
+	EncodingBase64 = "base64"
+
+	// CompressionGzip gzips values before they are encoded.
+	CompressionGzip = "gzip"
+)
+
+// sizeHeader holds the length of a value before it was compressed, so
+// Stat doesn't have to decompress it.
+const sizeHeader = "Caddy-Size"
+
+// checksumHeader holds the SHA-256 of the stored value.
+const checksumHeader = "Caddy-Checksum"
+
+// regionHeader holds the Region of the instance which stored the value.
+const regionHeader = "Caddy-Region"
+
+// gzipMagic starts every gzip stream, it tells compressed values apart
+// from ones stored before compression was enabled.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func validateEncoding(encoding string) error {
+	switch encoding {
+	case "", EncodingRaw, EncodingBase64:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q, must be %q or %q", encoding, EncodingRaw, EncodingBase64)
+}
+
+func validateCompression(compression string) error {
+	switch compression {
+	case "", CompressionGzip:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, must be %q", compression, CompressionGzip)
+}
+
+// encodeValue converts value to the representation stored in the bucket
+// and returns the headers to store along with it.
+func (n *Nats) encodeValue(value []byte) ([]byte, nats.Header) {
+	var hdr nats.Header
+	if n.Compression == CompressionGzip {
+		hdr = nats.Header{}
+		hdr.Set(sizeHeader, strconv.Itoa(len(value)))
+
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		// writes to a bytes.Buffer don't fail
+		zw.Write(value)
+		zw.Close()
+		value = buf.Bytes()
+	}
+
+	if n.Encoding == EncodingBase64 {
+		enc := make([]byte, base64.StdEncoding.EncodedLen(len(value)))
+		base64.StdEncoding.Encode(enc, value)
+		value = enc
+	}
+
+	if n.Checksum {
+		if hdr == nil {
+			hdr = nats.Header{}
+		}
+		hdr.Set(checksumHeader, checksum(value))
+	}
+
+	if n.Region != "" {
+		if hdr == nil {
+			hdr = nats.Header{}
+		}
+		hdr.Set(regionHeader, n.Region)
+	}
+	return value, hdr
+}
+
+func checksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// pemExtensions are the extensions of keys ValidatePEM checks.
+var pemExtensions = []string{".crt", ".key", ".pem"}
+
+// checkPEM validates value, before encoding, for key with ValidatePEM.
+func (n *Nats) checkPEM(key string, value []byte) error {
+	if !n.ValidatePEM || !slices.Contains(pemExtensions, path.Ext(key)) {
+		return nil
+	}
+
+	var blocks int
+	for rest := value; len(bytes.TrimSpace(rest)) > 0; blocks++ {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return fmt.Errorf("store %v: %w: unexpected data after %d blocks", key, ErrInvalidPEM, blocks)
+		}
+	}
+	if blocks == 0 {
+		return fmt.Errorf("store %v: %w: empty value", key, ErrInvalidPEM)
+	}
+	return nil
+}
+
+// dedupHeader adds the message id the server deduplicates Stores of
+// the encoded value at key by to hdr, which may be nil.
+func (n *Nats) dedupHeader(key string, value []byte, hdr nats.Header) nats.Header {
+	if hdr == nil {
+		hdr = nats.Header{}
+	}
+	id := append([]byte(n.natsKey(key)+"\x00"), value...)
+	hdr.Set(nats.MsgIdHdr, checksum(id))
+	return hdr
+}
+
+// verifyChecksum checks the stored value against the checksum header.
+// Values stored without a checksum are accepted.
+func verifyChecksum(value []byte, hdr nats.Header) error {
+	want := hdr.Get(checksumHeader)
+	if want == "" || want == checksum(value) {
+		return nil
+	}
+	return ErrChecksumMismatch
+}
+
+// decodeValue reverses encodeValue.
+func (n *Nats) decodeValue(value []byte) ([]byte, error) {
+	if n.Encoding == EncodingBase64 {
+		dec := make([]byte, base64.StdEncoding.DecodedLen(len(value)))
+		l, err := base64.StdEncoding.Decode(dec, value)
+		if err != nil {
+			return nil, fmt.Errorf("decode base64 value: %w", err)
+		}
+		value = dec[:l]
+	}
+
+	if n.Compression != CompressionGzip || !bytes.HasPrefix(value, gzipMagic) {
+		return value, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, fmt.Errorf("decompress value: %w", err)
+	}
+	value, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompress value: %w", err)
+	}
+	return value, nil
+}
+
+// valueSize returns the length value had when it was stored, without
+// decoding or decompressing it. hdr may be nil.
+func (n *Nats) valueSize(value []byte, hdr nats.Header) int64 {
+	if size, err := strconv.ParseInt(hdr.Get(sizeHeader), 10, 64); err == nil {
+		return size
+	}
+
+	if n.Encoding != EncodingBase64 {
+		return int64(len(value))
+	}
+	size := len(value) / 4 * 3
+	if bytes.HasSuffix(value, []byte("==")) {
+		size -= 2
+	} else if bytes.HasSuffix(value, []byte("=")) {
+		size--
+	}
+	return int64(size)
+}
@@ -0,0 +1,45 @@
+package certmagic_nats
+
+import (
+	"path"
+	"runtime/debug"
+)
+
+// modulePath is looked up in the build info for the module version.
+const modulePath = "github.com/jordan-rash/caddy-nats-storage"
+
+// moduleVersion returns the version of this module built into the
+// binary, e.g. v0.3.0 for a caddy built with xcaddy, "(devel)" for a
+// build from a checkout and "unknown" without build info.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != modulePath {
+			continue
+		}
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return "unknown"
+}
+
+// connectionName returns the name reported to the server, with
+// AdvertiseVersion ConnectionName followed by the module version tag.
+func (n *Nats) connectionName() string {
+	if !n.AdvertiseVersion {
+		return n.ConnectionName
+	}
+	tag := path.Base(modulePath) + "/" + moduleVersion()
+	if n.ConnectionName == "" {
+		return tag
+	}
+	return n.ConnectionName + " " + tag
+}
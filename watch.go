@@ -0,0 +1,167 @@
+package certmagic_nats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// KeyEvent describes a change of a key delivered by Subscribe.
+type KeyEvent struct {
+	Key      string
+	Value    []byte
+	Revision uint64
+	Deleted  bool
+}
+
+// watchOptions translates the configured consumer settings into
+// subscribe options.
+func (n *Nats) watchOptions(kv nats.KeyValue) ([]nats.SubOpt, error) {
+	opts := []nats.SubOpt{nats.BindStream(kvStream(kv))}
+	if n.WatchDurable != "" {
+		opts = append(opts, nats.Durable(n.WatchDurable))
+	}
+
+	switch n.WatchDeliverPolicy {
+	case "", "new":
+		opts = append(opts, nats.DeliverNew())
+	case "all":
+		opts = append(opts, nats.DeliverAll())
+	case "last":
+		opts = append(opts, nats.DeliverLast())
+	case "last_per_subject":
+		opts = append(opts, nats.DeliverLastPerSubject())
+	default:
+		return nil, fmt.Errorf("unknown watch_deliver_policy %q", n.WatchDeliverPolicy)
+	}
+
+	switch n.WatchAckPolicy {
+	case "", "none":
+		opts = append(opts, nats.AckNone())
+	case "all":
+		opts = append(opts, nats.AckAll())
+	case "explicit":
+		opts = append(opts, nats.AckExplicit())
+	default:
+		return nil, fmt.Errorf("unknown watch_ack_policy %q", n.WatchAckPolicy)
+	}
+
+	return opts, nil
+}
+
+// setPendingLimits applies SubPendingMsgsLimit and SubPendingBytesLimit
+// to sub, keeping the current value of a limit that isn't set.
+func (n *Nats) setPendingLimits(sub *nats.Subscription) error {
+	if n.SubPendingMsgsLimit == 0 && n.SubPendingBytesLimit == 0 {
+		return nil
+	}
+
+	msgs, bytes, err := sub.PendingLimits()
+	if err != nil {
+		return err
+	}
+	if n.SubPendingMsgsLimit != 0 {
+		msgs = n.SubPendingMsgsLimit
+	}
+	if n.SubPendingBytesLimit != 0 {
+		bytes = n.SubPendingBytesLimit
+	}
+	return sub.SetPendingLimits(msgs, bytes)
+}
+
+// Subscribe delivers changes of all keys below prefix until ctx is
+// done. The consumer, configured by the Watch fields, is removed from
+// the server once ctx is done unless it existed before.
+func (n *Nats) Subscribe(ctx context.Context, prefix string) (<-chan KeyEvent, error) {
+	n.logger.Info(fmt.Sprintf("Subscribe: %v", prefix))
+	if err := n.connErr(); err != nil {
+		return nil, fmt.Errorf("subscribe %v: %w", prefix, err)
+	}
+
+	kv, js := n.reader()
+	if kv == nil {
+		return nil, fmt.Errorf("subscribe %v: %w", prefix, ErrNotConnected)
+	}
+
+	opts, err := n.watchOptions(kv)
+	if err != nil {
+		return nil, err
+	}
+
+	// a handler subscription rather than a channel one, pending limits
+	// can't be set on the latter
+	msgs := make(chan *nats.Msg)
+	sub, err := js.Subscribe(kvSubject(kv, n.watchFilter(canonicalPrefix(n.canonicalKey(prefix)))), func(msg *nats.Msg) {
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+		}
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.setPendingLimits(sub); err != nil {
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("subscribe %v: %w", prefix, err)
+	}
+
+	events := make(chan KeyEvent)
+	go func() {
+		defer close(events)
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-msgs:
+				if n.WatchAckPolicy == "all" || n.WatchAckPolicy == "explicit" {
+					msg.Ack()
+				}
+
+				event, err := n.keyEvent(kv, msg)
+				if err != nil {
+					n.logger.Error(fmt.Sprintf("Subscribe: %v: %v", msg.Subject, err))
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// keyEvent converts a message of the bucket stream into a KeyEvent.
+func (n *Nats) keyEvent(kv nats.KeyValue, msg *nats.Msg) (KeyEvent, error) {
+	nkey := strings.TrimPrefix(msg.Subject, kvSubject(kv, ""))
+	event := KeyEvent{Key: n.denormalize(nkey)}
+	if isHashedKey(nkey) || (n.ObfuscateKeysSecret != "" && isObfuscated(nkey)) {
+		event.Key = msg.Header.Get(keyHeader)
+	}
+	event.Key, _ = n.stripPrefix(event.Key)
+
+	if meta, err := msg.Metadata(); err == nil {
+		event.Revision = meta.Sequence.Stream
+	}
+
+	switch msg.Header.Get("KV-Operation") {
+	case "DEL", "PURGE":
+		event.Deleted = true
+		return event, nil
+	}
+
+	value, err := n.decodeValue(msg.Data)
+	if err != nil {
+		return event, err
+	}
+	event.Value = value
+	return event, nil
+}
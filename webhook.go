@@ -0,0 +1,146 @@
+package certmagic_nats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultWebhookInterval is the minimum time between two webhook calls
+// for the same event when WebhookInterval isn't set.
+const defaultWebhookInterval = 10 * time.Second
+
+// WebhookEvent is the JSON payload posted to the Webhooks.
+type WebhookEvent struct {
+	// Event is one of "connect", "disconnect", "reconnect",
+	// "jetstream_error", "read_only" or "writable".
+	Event      string    `json:"event"`
+	Connection string    `json:"connection,omitempty"`
+	Server     string    `json:"server,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+	// Suppressed counts the events of the same kind left out since the
+	// previous call because of the rate limit.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// webhooks posts connection events to URLs in the background, at most
+// once per interval for each kind of event. A nil webhooks posts
+// nothing.
+type webhooks struct {
+	urls     []string
+	interval time.Duration
+	client   *http.Client
+	logger   *zap.Logger
+
+	events chan WebhookEvent
+	done   chan struct{}
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+func newWebhooks(urls []string, interval time.Duration, logger *zap.Logger) *webhooks {
+	if len(urls) == 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = defaultWebhookInterval
+	}
+
+	w := &webhooks{
+		urls:       urls,
+		interval:   interval,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		logger:     logger,
+		events:     make(chan WebhookEvent, 16),
+		done:       make(chan struct{}),
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	go w.run()
+	return w
+}
+
+// notify queues event without blocking the caller.
+func (w *webhooks) notify(event WebhookEvent) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	if time.Since(w.last[event.Event]) < w.interval {
+		w.suppressed[event.Event]++
+		w.mu.Unlock()
+		return
+	}
+	w.last[event.Event] = time.Now()
+	event.Suppressed, w.suppressed[event.Event] = w.suppressed[event.Event], 0
+	w.mu.Unlock()
+
+	event.Time = time.Now().UTC()
+	select {
+	case w.events <- event:
+	default:
+		w.logger.Warn(fmt.Sprintf("Webhook queue full, dropping %v event", event.Event))
+	}
+}
+
+func (w *webhooks) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case event := <-w.events:
+			body, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			for _, url := range w.urls {
+				if err := w.post(url, body); err != nil {
+					w.logger.Warn(fmt.Sprintf("Webhook %v for %v event: %v", url, event.Event, err))
+				}
+			}
+		}
+	}
+}
+
+func (w *webhooks) post(url string, body []byte) error {
+	resp, err := w.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// stop ends the background posting, queued events are dropped.
+func (w *webhooks) stop() {
+	if w == nil {
+		return
+	}
+
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+}
+
+// notifyConn sends a webhook for a connection event.
+func (n *Nats) notifyConn(event, server string, err error) {
+	e := WebhookEvent{Event: event, Connection: n.ConnectionName, Server: server}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	n.webhooks.notify(e)
+}